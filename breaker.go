@@ -0,0 +1,168 @@
+package messaging
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+const defaultBreakerCooldown = "1m"
+
+// BreakerStatus describes the circuit breaker of a provider
+type BreakerStatus struct {
+	Provider            string     `json:"provider"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Threshold           int        `json:"threshold"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+	LastError           string     `json:"lastError"`
+	Secondary           string     `json:"secondary"`
+}
+
+// circuitBreaker stops batches from being sent to a provider after a number of
+// consecutive failures.  Once the cooldown has passed, a single batch is let
+// through as a probe.  If the probe succeeds the breaker closes again, otherwise
+// it stays open for another cooldown period.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	status   BreakerStatus
+	cooldown time.Duration
+	probing  bool
+}
+
+// Breakers holds the circuit breakers of all providers that have failover configured
+type Breakers struct {
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+// get returns the breaker for the provider, or nil if the provider does not use one
+func (bs *Breakers) get(p ConfigSmsProvider) *circuitBreaker {
+	if p.Failover.Threshold <= 0 {
+		return nil
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.breakers == nil {
+		bs.breakers = map[string]*circuitBreaker{}
+	}
+	b, ok := bs.breakers[p.key()]
+	if !ok {
+		b = &circuitBreaker{
+			status: BreakerStatus{
+				Provider:  p.key(),
+				State:     breakerClosed,
+				Threshold: p.Failover.Threshold,
+				Secondary: p.Failover.Secondary,
+			},
+			cooldown: parseDurationOrDefault(p.Failover.Cooldown, defaultBreakerCooldown),
+		}
+		bs.breakers[p.key()] = b
+	}
+	return b
+}
+
+// Status returns the state of every breaker, ordered by provider
+func (bs *Breakers) Status() []BreakerStatus {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	res := []BreakerStatus{}
+	for _, b := range bs.breakers {
+		b.mu.Lock()
+		res = append(res, b.status)
+		b.mu.Unlock()
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Provider < res[j].Provider })
+	return res
+}
+
+// allow reports whether a batch may be sent through the provider.  When the
+// cooldown of an open breaker has passed, only the first caller is allowed
+// through as a probe.
+func (b *circuitBreaker) allow(s *MessagingServer) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.status.State {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(*b.status.OpenedAt) < b.cooldown {
+			return false
+		}
+		s.Log.Infof("Circuit breaker for provider %v is half-open, sending a probe", b.status.Provider)
+		b.status.State = breakerHalfOpen
+		b.probing = true
+		return true
+	}
+	// Half-open: wait for the outcome of the probe
+	if b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record updates the breaker with the outcome of a batch
+func (b *circuitBreaker) record(s *MessagingServer, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probe := b.status.State == breakerHalfOpen
+	b.probing = false
+	if err == nil {
+		if b.status.State != breakerClosed {
+			s.Log.Infof("Circuit breaker for provider %v is closed", b.status.Provider)
+		}
+		b.status.State = breakerClosed
+		b.status.ConsecutiveFailures = 0
+		b.status.OpenedAt = nil
+		return
+	}
+
+	b.status.ConsecutiveFailures++
+	b.status.LastError = err.Error()
+	if probe || (b.status.State == breakerClosed && b.status.ConsecutiveFailures >= b.status.Threshold) {
+		now := time.Now().UTC()
+		b.status.State = breakerOpen
+		b.status.OpenedAt = &now
+		s.Log.Warnf("Circuit breaker for provider %v is open after %v consecutive failures: %v",
+			b.status.Provider, b.status.ConsecutiveFailures, err)
+	}
+}
+
+// selectProvider returns the provider to send a batch through.  If the breaker
+// of the routed provider is open, its secondary provider is used instead.  An
+// error is returned if neither is available.
+func (s *MessagingServer) selectProvider(p ConfigSmsProvider) (ConfigSmsProvider, *circuitBreaker, error) {
+	tried := map[string]bool{}
+	for {
+		b := s.Breakers.get(p)
+		if b.allow(s) {
+			return p, b, nil
+		}
+		tried[p.key()] = true
+		sec := p.Failover.Secondary
+		if sec == "" || tried[sec] {
+			return p, nil, fmt.Errorf("Provider %v is unavailable", p.key())
+		}
+		secP, ok := s.Config.provider(sec)
+		if !ok {
+			return p, nil, fmt.Errorf("Provider %v is unavailable, and secondary provider %v is not configured", p.key(), sec)
+		}
+		s.Log.Debugf("Provider %v is unavailable, failing over to %v", p.key(), sec)
+		p = secP
+	}
+}
@@ -0,0 +1,91 @@
+package messaging
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	s := testServer()
+	p := ConfigSmsProvider{Name: "MockProvider", Failover: ConfigFailover{Threshold: 2, Cooldown: "1h"}}
+	b := s.Breakers.get(p)
+	errSend := errors.New("Provider unavailable")
+
+	// Each step either records the outcome of a batch, lets the cooldown pass,
+	// or asks whether a batch may be sent.  The state is checked after every step.
+	const (
+		fail = iota
+		succeed
+		cooldown
+		allow
+		deny
+	)
+	for i, c := range []struct {
+		step     int
+		state    string
+		failures int
+	}{
+		{fail, breakerClosed, 1},
+		{allow, breakerClosed, 1},
+		{fail, breakerOpen, 2}, // Threshold reached
+		{deny, breakerOpen, 2}, // Still cooling down
+		{cooldown, breakerOpen, 2},
+		{allow, breakerHalfOpen, 2}, // The probe
+		{deny, breakerHalfOpen, 2},  // Only one probe at a time
+		{fail, breakerOpen, 3},      // A failed probe opens the breaker again
+		{deny, breakerOpen, 3},
+		{cooldown, breakerOpen, 3},
+		{allow, breakerHalfOpen, 3},
+		{succeed, breakerClosed, 0}, // A successful probe closes the breaker
+		{allow, breakerClosed, 0},
+		{allow, breakerClosed, 0},
+	} {
+		switch c.step {
+		case fail:
+			b.record(s, errSend)
+		case succeed:
+			b.record(s, nil)
+		case cooldown:
+			past := time.Now().Add(-2 * time.Hour)
+			b.status.OpenedAt = &past
+		case allow, deny:
+			if got := b.allow(s); got != (c.step == allow) {
+				t.Errorf("Step %v: allow() = %v", i, got)
+			}
+		}
+		if b.status.State != c.state || b.status.ConsecutiveFailures != c.failures {
+			t.Errorf("Step %v: Expected %v with %v failures, got %v with %v failures",
+				i, c.state, c.failures, b.status.State, b.status.ConsecutiveFailures)
+		}
+	}
+	if b.status.OpenedAt != nil {
+		t.Errorf("Expected a closed breaker not to have an opening time")
+	}
+}
+
+func TestSelectProviderFailover(t *testing.T) {
+	s := testServer()
+	primary := ConfigSmsProvider{Name: "Primary", Failover: ConfigFailover{Threshold: 1, Cooldown: "1h", Secondary: "Secondary"}}
+	secondary := ConfigSmsProvider{Name: "Secondary", Enabled: true, Failover: ConfigFailover{Threshold: 1, Cooldown: "1h"}}
+	s.Config.SMSProvider = primary
+	s.Config.SMSProviders = []ConfigSmsProvider{secondary}
+
+	for _, c := range []struct {
+		open    []ConfigSmsProvider // Breakers that are opened before selecting
+		want    string
+		wantErr bool
+	}{
+		{nil, "Primary", false},
+		{[]ConfigSmsProvider{primary}, "Secondary", false},
+		{[]ConfigSmsProvider{secondary}, "Secondary", true},
+	} {
+		for _, p := range c.open {
+			s.Breakers.get(p).record(s, errors.New("Provider unavailable"))
+		}
+		p, _, err := s.selectProvider(primary)
+		if (err != nil) != c.wantErr || (err == nil && p.key() != c.want) {
+			t.Errorf("With %v open: selectProvider() = %v, %v, want %v", len(c.open), p.key(), err, c.want)
+		}
+	}
+}
@@ -11,13 +11,14 @@ type ClickatellSender struct {
 
 // SendSMS implements the SendSMS method and converts
 // Clickatell specific formats to the generic SMS structures.
-func (c ClickatellSender) SendSMS(s *MessagingServer, m message) ([]SendSMSResponseMessage, error) {
+func (c ClickatellSender) SendSMS(s *MessagingServer, m Message) ([]SendSMSResponseMessage, error) {
 	rest := clickatell.Rest(m.Provider.Token, nil)
 	cm := clickatell.Message{
 		Destination: m.Destination,
 		Body:        m.Text,
 		ClientMsgId: m.ProviderID,
 		From:        m.From,
+		Unicode:     m.Encoding == EncodingUCS2,
 	}
 	resp, err := rest.Send(cm)
 	if err == nil {
@@ -40,8 +41,8 @@ func (c ClickatellSender) SendSMS(s *MessagingServer, m message) ([]SendSMSRespo
 
 // GetStatus retrieves the delivery status of a mobile number
 // using the Clickatell service.
-func (c ClickatellSender) GetStatus(s *MessagingServer, m message) ([]SendSMSResponseMessage, error) {
-	rest := clickatell.Rest(s.Config.SMSProvider.Token, nil)
+func (c ClickatellSender) GetStatus(s *MessagingServer, m Message) ([]SendSMSResponseMessage, error) {
+	rest := clickatell.Rest(m.Provider.Token, nil)
 	st, err := rest.GetStatus(m.ProviderID)
 	var msRess []SendSMSResponseMessage
 	if err != nil {
@@ -53,11 +54,24 @@ func (c ClickatellSender) GetStatus(s *MessagingServer, m message) ([]SendSMSRes
 		ErrorCode: clickatellMapCode(st.Data.StatusCode),
 		ErrorDesc: st.Data.Description,
 		Segments:  st.Data.Charge,
+		RawStatus: st.Data.StatusCode,
 	})
 
 	return msRess, nil
 }
 
+// HandleCallback updates the status of a message from a delivery receipt that
+// was pushed by Clickatell.
+func (c ClickatellSender) HandleCallback(s *MessagingServer, cb *clickatell.StatusCallback) error {
+	sendLogID, err := s.DB.getSendLogID(cb.APIMessageID)
+	if err != nil {
+		return err
+	}
+	st := clickatellMapCode(string(cb.StatusCode))
+	desc := clickatell.StatusDescription(cb.StatusCode)
+	return s.DB.updateSMSData(cb.APIMessageID, st, desc, string(cb.StatusCode), statusSourceCallback, sendLogID, cb.Segments())
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
 func clickatellMapCode(c string) string {
@@ -79,9 +93,8 @@ func getError(r *clickatell.SendResponse, e error) error {
 
 	mErrCode := r.Data.Message[0].Error.Code
 	mErrDesc := r.Data.Message[0].Error.Description
-	var err error
-	if mErrCode != "" {
-		err = errors.New(mErrCode + ": " + mErrDesc)
+	if mErrCode == "" {
+		return nil
 	}
-	return err
+	return clickatell.MakeError(clickatell.ErrorResponse{Code: mErrCode, Description: mErrCode + ": " + mErrDesc})
 }
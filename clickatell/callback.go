@@ -0,0 +1,112 @@
+package clickatell
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// StatusCallback is a delivery receipt that Clickatell pushes to the callback
+// URL configured for the API.  Receipts are sent either as a JSON object or as
+// form-encoded values, using the same field names.
+type StatusCallback struct {
+	APIMessageID    string      `json:"apiMsgId"`
+	ClientMessageID string      `json:"cliMsgId"`
+	To              string      `json:"to"`
+	From            string      `json:"from"`
+	Timestamp       json.Number `json:"timestamp"`
+	StatusCode      StatusCode  `json:"status"`
+	Charge          json.Number `json:"charge"`
+}
+
+// StatusCode is a three digit Clickatell message status code, such as "004".
+// Callbacks may contain it as either a JSON string or a number.
+type StatusCode string
+
+func (c *StatusCode) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	}
+	*c = NormalizeStatusCode(s)
+	return nil
+}
+
+// statusDescriptions are Clickatell's descriptions of its message status codes
+var statusDescriptions = map[StatusCode]string{
+	"001": "Message unknown",
+	"002": "Message queued",
+	"003": "Delivered to gateway",
+	"004": "Received by recipient",
+	"005": "Error with message",
+	"006": "User cancelled message delivery",
+	"007": "Error delivering message",
+	"009": "Routing error",
+	"010": "Message expired",
+	"011": "Message scheduled for later delivery",
+	"012": "Out of credit",
+	"013": "Clickatell cancelled message delivery",
+	"014": "Maximum MT limit exceeded",
+}
+
+// StatusDescription returns the description of a status code, or the code
+// itself if it is not known
+func StatusDescription(c StatusCode) string {
+	if d, ok := statusDescriptions[c]; ok {
+		return d
+	}
+	return "Status " + string(c)
+}
+
+// NormalizeStatusCode zero-pads a numeric status code to three digits
+func NormalizeStatusCode(s string) StatusCode {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.Atoi(s); err == nil && len(s) < 3 {
+		s = strconv.Itoa(1000 + n)[1:]
+	}
+	return StatusCode(s)
+}
+
+// Segments returns the charge of the message, rounded up to a whole number
+func (cb *StatusCallback) Segments() int {
+	f, err := cb.Charge.Float64()
+	if err != nil {
+		return 0
+	}
+	n := int(f)
+	if float64(n) < f {
+		n++
+	}
+	return n
+}
+
+// ParseCallback reads a delivery receipt from a callback request
+func ParseCallback(r *http.Request) (*StatusCallback, error) {
+	cb := &StatusCallback{}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(cb); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		cb.APIMessageID = r.Form.Get("apiMsgId")
+		cb.ClientMessageID = r.Form.Get("cliMsgId")
+		cb.To = r.Form.Get("to")
+		cb.From = r.Form.Get("from")
+		cb.Timestamp = json.Number(r.Form.Get("timestamp"))
+		cb.StatusCode = NormalizeStatusCode(r.Form.Get("status"))
+		cb.Charge = json.Number(r.Form.Get("charge"))
+	}
+	if cb.APIMessageID == "" || cb.StatusCode == "" {
+		return nil, errors.New("clickatell: callback does not contain a message ID and status")
+	}
+	return cb, nil
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 )
 
 const (
@@ -16,6 +17,7 @@ type Message struct {
 	Destination []string `url:"-" json:"to"`
 	Body        string   `url:"text" json:"text"`
 	From        string   `url:"from,omitempty" json:"from"`
+	Unicode     bool     `url:"unicode,omitempty" json:"unicode,omitempty"` // Send the text as UCS-2
 }
 
 type GetStatusResponse struct {
@@ -60,6 +62,32 @@ type ClickatellErr struct {
 	Code string
 }
 
+// ErrorCode returns the Clickatell error code
+func (e *ClickatellErr) ErrorCode() string {
+	return e.Code
+}
+
+// StatusError is returned when Clickatell responds with an unsuccessful HTTP status
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("clickatell: %v", e.Status)
+}
+
+// ErrorCode returns the HTTP status code
+func (e *StatusError) ErrorCode() string {
+	return strconv.Itoa(e.StatusCode)
+}
+
+// IsServerError reports whether the response indicates that Clickatell is
+// overloaded or temporarily unavailable, in which case the body is not a valid API response.
+func IsServerError(r *http.Response) bool {
+	return r.StatusCode >= 500 || r.StatusCode == http.StatusTooManyRequests
+}
+
 func (e *ErrorResponse) HasError() bool {
 	return e.Description != ""
 }
@@ -82,6 +110,6 @@ func getSuccessStatus(r *http.Response) error {
 	case 202:
 		return nil
 	default:
-		return fmt.Errorf("clickatell: %v", r.Status)
+		return &StatusError{StatusCode: r.StatusCode, Status: r.Status}
 	}
 }
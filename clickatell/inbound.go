@@ -0,0 +1,49 @@
+package clickatell
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+)
+
+// InboundMessage is a reply (mobile originated message) that Clickatell pushes
+// to the reply callback URL of the integration.  Replies are sent either as a
+// JSON object, or as form-encoded values with the field names of the older HTTP
+// API.
+type InboundMessage struct {
+	MessageID      string      `json:"messageId"`
+	ReplyMessageID string      `json:"replyMessageId"`
+	From           string      `json:"fromNumber"`
+	To             string      `json:"toNumber"`
+	Timestamp      json.Number `json:"timestamp"`
+	Text           string      `json:"text"`
+	Charset        string      `json:"charset"`
+	Network        json.Number `json:"network"`
+	Keyword        string      `json:"keyword"`
+}
+
+// ParseInbound reads a reply from a reply callback request
+func ParseInbound(r *http.Request) (*InboundMessage, error) {
+	m := &InboundMessage{}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		m.MessageID = r.Form.Get("moMsgId")
+		m.From = r.Form.Get("from")
+		m.To = r.Form.Get("to")
+		m.Timestamp = json.Number(r.Form.Get("timestamp"))
+		m.Text = r.Form.Get("text")
+		m.Charset = r.Form.Get("charset")
+	}
+	if m.From == "" {
+		return nil, errors.New("clickatell: reply does not contain a sender number")
+	}
+	return m, nil
+}
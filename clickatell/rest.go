@@ -38,6 +38,10 @@ func (c *RestClient) Send(in Message) (*SendResponse, error) {
 	result := &SendResponse{}
 
 	if err == nil {
+		defer resp.Body.Close()
+		if IsServerError(resp) {
+			return result, getSuccessStatus(resp)
+		}
 		err = json.NewDecoder(resp.Body).Decode(result)
 		if err == nil {
 			err = result.Error.GetError(resp)
@@ -2,6 +2,9 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/IMQS/cli"
 	"github.com/IMQS/messaging"
@@ -42,8 +45,20 @@ func exec(cmdName string, args []string, options cli.OptionSet) int {
 	switch cmdName {
 	case "run":
 		if !messaging.RunAsService(run) {
-			run()
+			// Run until the server fails, or the process is interrupted
+			done := make(chan struct{})
+			go func() {
+				run()
+				close(done)
+			}()
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			select {
+			case <-done:
+			case <-sig:
+			}
 		}
+		server.Close()
 	default:
 		fmt.Printf("Unknown command %v\n", cmdName)
 	}
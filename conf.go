@@ -1,6 +1,9 @@
 package messaging
 
 import (
+	"encoding/json"
+	"io"
+
 	"github.com/IMQS/log"
 	"github.com/IMQS/serviceconfigsgo"
 )
@@ -17,8 +20,40 @@ Sample config:
 		"token": "123abc",
 		"maxMessageSegments": 1,
 		"maxBatchSize": 600,
-		"countries": ["ZA", "BW", "US"]
+		"countries": ["ZA", "BW", "US"],
+		"mobileOnly": true,
+		"costPerSegment": 0.25,
+		"retry": {
+			"maxAttempts": 4,
+			"initialBackoff": "2s",
+			"maxBackoff": "1m",
+			"multiplier": 2,
+			"jitter": 0.2,
+			"retryableCodes": ["429", "500", "502", "503", "504"]
+		},
+		"callback": {
+			"enabled": true,
+			"secret": "s3cr3t"
+		},
+		"failover": {
+			"threshold": 5,
+			"cooldown": "1m",
+			"secondary": "clickatell-bw"
+		}
 	},
+	"smsProviders": [
+		{
+			"id": "clickatell-bw",
+			"name": "Clickatell",
+			"enabled": true,
+			"token": "456def",
+			"maxBatchSize": 500,
+			"routing": {
+				"countryCodes": ["267"],
+				"weight": 1
+			}
+		}
+	],
 	"authentication": {
 		"service": "serviceauth",
 		"enabled": true
@@ -27,6 +62,39 @@ Sample config:
 		"enabled": true,
 		"updateInverval": 15
 	},
+	"queue": {
+		"enabled": true,
+		"workers": 4,
+		"pollInterval": "5s",
+		"processingTimeout": "10m"
+	},
+	"email": {
+		"enabled": true,
+		"host": "smtp.example.com",
+		"port": 587,
+		"username": "notify",
+		"password": "123",
+		"from": "IMQS Notifications <noreply@example.com>",
+		"tls": "starttls",
+		"maxBatchSize": 100
+	},
+	"schedule": {
+		"checkInterval": "1m",
+		"processingTimeout": "10m"
+	},
+	"inbound": {
+		"optOutKeywords": ["STOP", "UNSUBSCRIBE", "OPTOUT"],
+		"confirmationReply": "You have been unsubscribed from IMQS notifications."
+	},
+	"sendWindows": [
+		{
+			"countryCodes": ["27", "267"],
+			"timeZone": "Africa/Johannesburg",
+			"start": "07:00",
+			"end": "20:00",
+			"days": ["Mon", "Tue", "Wed", "Thu", "Fri", "Sat"]
+		}
+	],
 	"dbConnection": {
 		"Driver": "postgres",
 		"Host": "localhost",
@@ -45,28 +113,99 @@ const serviceConfigVersion = 1
 const serviceName = "ImqsMessaging"
 
 type MessagingServer struct {
-	Config   Configuration
-	Log      *log.Logger
-	DB       sqlNotifyDB
-	Interval IntervalService
+	Config     Configuration
+	Log        *log.Logger
+	DB         sqlNotifyDB
+	Interval   IntervalService
+	Dispatcher Dispatcher
+	Breakers   Breakers
+	senders    senderCache
+	windows    []sendWindow
 }
 
 type Configuration struct {
 	HTTPPort       int
 	Logfile        string
 	SMSProvider    ConfigSmsProvider
+	SMSProviders   []ConfigSmsProvider
 	Authentication ConfigAuth
 	DeliveryStatus ConfigDeliveryInterval
+	Queue          ConfigQueue
+	Email          ConfigEmail
+	Schedule       ConfigSchedule
+	SendWindows    []ConfigSendWindow
+	Inbound        ConfigInbound
 	DBConnection   ConfigDBConnection
 }
 
+// ConfigSmsProvider configures a provider that messages can be sent through.
+// The primary provider also determines the message length and the countries
+// that numbers are accepted for.
 type ConfigSmsProvider struct {
+	ID                 string // Distinguishes between providers with the same name. Defaults to the name
 	Name               string
 	Enabled            bool
 	Token              string
 	MaxMessageSegments int
 	MaxBatchSize       int
-	Countries          []string
+	Countries          []string // Countries that numbers are accepted for, e.g. "ZA". National numbers are tried against each in turn
+	MobileOnly         bool     // Reject numbers that can't be mobile numbers, such as landlines
+	CostPerSegment     float64  // Used to estimate the cost of a message
+	Retry              ConfigRetry
+	Callback           ConfigCallback
+	Routing            ConfigRouting
+	Failover           ConfigFailover
+	Raw                json.RawMessage `json:"-"` // The provider's entire config block, passed to its SenderFactory
+}
+
+// UnmarshalJSON keeps a copy of the provider's config block, so that providers
+// registered with RegisterSender can read their own settings from it.
+func (p *ConfigSmsProvider) UnmarshalJSON(b []byte) error {
+	type plain ConfigSmsProvider
+	if err := json.Unmarshal(b, (*plain)(p)); err != nil {
+		return err
+	}
+	p.Raw = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+// ConfigFailover controls the circuit breaker of a provider.  After Threshold
+// consecutive failed batches, batches are sent through the secondary provider
+// instead, until a probe batch sent after the cooldown succeeds.
+type ConfigFailover struct {
+	Threshold int    // Consecutive failed batches that open the breaker. 0 disables the breaker
+	Cooldown  string // Time to wait before probing the provider again
+	Secondary string // ID of the provider to send through while the breaker is open
+}
+
+// ConfigRouting determines which numbers are sent through a provider.  A provider
+// without any rules accepts all numbers.  When more than one provider matches a
+// number, the ones with rules on the country code are preferred, followed by
+// the ones with rules on the originator, and the remaining candidates share the
+// traffic according to their weights.
+type ConfigRouting struct {
+	CountryCodes []string // International dialling codes of the destinations, e.g. "27"
+	Originators  []string // Identities of the users whose messages are sent through the provider
+	Weight       int      // Relative share of the matching traffic. Defaults to 1
+}
+
+// ConfigCallback controls delivery receipts that are pushed by the provider.
+// When enabled, the delivery status is no longer polled.  The secret must be
+// included in the callback URL configured at the provider.
+type ConfigCallback struct {
+	Enabled bool
+	Secret  string
+}
+
+// ConfigRetry controls how often a batch is sent again after a transient
+// failure, such as a network error or an overloaded provider.
+type ConfigRetry struct {
+	MaxAttempts    int      // Total number of attempts, including the first. 0 or 1 disables retries
+	InitialBackoff string   // Time to wait before the first retry
+	MaxBackoff     string   // Upper limit of the time between attempts
+	Multiplier     float64  // Factor by which the wait increases after every attempt
+	Jitter         float64  // Fraction by which each wait is randomly adjusted, between 0 and 1
+	RetryableCodes []string // Provider error codes or HTTP statuses that are retried
 }
 
 type ConfigAuth struct {
@@ -90,7 +229,53 @@ type ConfigDeliveryInterval struct {
 	UpdateInterval string
 }
 
-// Initialize opens a log file, opens the DB and starts the interval ticker.
+// ConfigEmail configures the SMTP server that emails are sent through.
+type ConfigEmail struct {
+	Enabled      bool
+	Host         string
+	Port         int    // Defaults to 25, or 465 for implicit TLS
+	Username     string // Leave empty if the server does not require authentication
+	Password     string
+	From         string // Sender address, e.g. "IMQS Notifications <noreply@imqs.co.za>"
+	TLS          string // "starttls" (default), "tls" for implicit TLS, or "none"
+	MaxBatchSize int    // Max number of recipients per sendlog entry
+}
+
+// ConfigSchedule controls how often the IntervalService checks for scheduled sends that are due
+type ConfigSchedule struct {
+	CheckInterval     string // Defaults to 1m
+	ProcessingTimeout string // Time after which a send that is still being processed is assumed to be interrupted. Defaults to 10m
+}
+
+// ConfigSendWindow is the time of day that normal priority messages may be sent
+// to numbers with the given country dialling codes.  A window without country
+// codes applies to all other numbers.
+type ConfigSendWindow struct {
+	CountryCodes []string
+	TimeZone     string   // e.g. "Africa/Johannesburg". Defaults to UTC
+	Start        string   // Opening time, e.g. "07:00"
+	End          string   // Closing time, e.g. "20:00". May be earlier than Start for a window that runs past midnight
+	Days         []string // Days that the window opens, e.g. ["Mon", "Tue"]. Defaults to every day
+}
+
+// ConfigInbound controls the handling of replies from recipients
+type ConfigInbound struct {
+	OptOutKeywords    []string // Replies starting with these words opt the number out. Defaults to STOP and UNSUBSCRIBE
+	ConfirmationReply string   // Optional message sent to numbers that opted out
+	Originator        string   // Originator recorded for confirmation replies. Defaults to "inbound"
+}
+
+// ConfigQueue controls the outbound queue.  When enabled, send requests are
+// written to the DB and sent in the background by a pool of workers.
+type ConfigQueue struct {
+	Enabled           bool
+	Workers           int
+	PollInterval      string
+	ProcessingTimeout string // Time after which a batch that is still being sent is assumed to be interrupted. Defaults to 10m
+}
+
+// Initialize opens a log file, opens the DB and starts the interval ticker and
+// the outbound queue dispatcher.
 func (s *MessagingServer) Initialize() error {
 	var err error
 
@@ -113,8 +298,32 @@ func (s *MessagingServer) Initialize() error {
 	if err = s.runMigrations(); err != nil {
 		return err
 	}
+	if s.windows, err = s.Config.sendWindows(); err != nil {
+		s.Log.Errorf("%v", err)
+		return err
+	}
+	if err = s.createSenders(); err != nil {
+		s.Log.Errorf("%v", err)
+		return err
+	}
 	s.startInterval()
-	return nil
+	return s.startDispatcher()
+}
+
+// Close stops the interval ticker and the outbound queue dispatcher, waiting for
+// any batches that are busy being sent, and closes provider connections.
+func (s *MessagingServer) Close() {
+	s.Interval.Stop()
+	s.Dispatcher.Stop()
+	s.senders.mu.Lock()
+	defer s.senders.mu.Unlock()
+	for id, sender := range s.senders.senders {
+		if c, ok := sender.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				s.Log.Warnf("Could not close provider %v: %v", id, err)
+			}
+		}
+	}
 }
 
 // NewConfig reads the config file
@@ -2,22 +2,560 @@ package messaging
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/migration"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type sqlNotifyDB struct {
 	db *sql.DB
 }
 
+// CreateCampaign creates the parent entry for a send request on the channel
+// ("sms" or "email"), before any of its batches are sent, and returns the new
+// campaign ID.
+func (x *sqlNotifyDB) createCampaign(channel, messageText, email string, quantity, batches int) (string, error) {
+	var id int
+	err := x.db.QueryRow(`INSERT INTO campaign
+		(senttime, originator, type, quantity, batches, failedbatches, message, status, description)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		time.Now().UTC(), email, channel, quantity, batches, 0, messageText, Sent, "").Scan(&id)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(id), nil
+}
+
+// EnqueueCampaign creates a campaign and adds each of the routed numbers to the
+// outbound queue, numbered into batches of the provider's batch size.  Each
+// entry holds the text of its route, which differs from the campaign's message
+// when the messages are personalised.  The queue
+// entries are written in a single transaction so that a campaign is never
+// partially queued.
+func (x *sqlNotifyDB) enqueueCampaign(messageText, email string, quantity int, routes []providerRoute) (string, error) {
+	tx, err := x.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	nb := 0
+	for _, rt := range routes {
+		nb += rt.Provider.batchCount(len(rt.MSISDNs))
+	}
+
+	var id int
+	now := time.Now().UTC()
+	err = tx.QueryRow(`INSERT INTO campaign
+		(senttime, originator, type, quantity, batches, failedbatches, message, status, description)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		now, email, channelSMS, quantity, nb, 0, messageText, Queued, "").Scan(&id)
+	if err != nil {
+		return "", err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("smsqueue", "campaignid", "batch", "provider", "msisdn", "message", "originator", "status", "queuedtime"))
+	if err != nil {
+		return "", err
+	}
+	first := 1
+	for _, rt := range routes {
+		bs := rt.Provider.batchSize(len(rt.MSISDNs))
+		for i, n := range rt.MSISDNs {
+			if _, err := stmt.Exec(id, first+i/bs, rt.Provider.key(), n, rt.Text, email, Queued, now); err != nil {
+				stmt.Close()
+				return "", err
+			}
+		}
+		first += rt.Provider.batchCount(len(rt.MSISDNs))
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return "", err
+	}
+	if err := stmt.Close(); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(id), tx.Commit()
+}
+
+// queuedBatch is a batch of messages claimed from the outbound queue.
+type queuedBatch struct {
+	IDs        []int64
+	CampaignID string
+	Batch      int
+	Provider   string
+	Message    string
+	Originator string
+	MSISDNs    []string
+}
+
+// ClaimQueuedBatch marks the oldest queued batch as being processed and returns
+// it.  It returns nil if the queue is empty.  Entries that are locked by another
+// instance of the service are skipped, so an entry is never claimed twice.
+func (x *sqlNotifyDB) claimQueuedBatch() (*queuedBatch, error) {
+	rows, err := x.db.Query(`UPDATE smsqueue SET status = $1, processedtime = $2
+		WHERE id IN (SELECT id FROM smsqueue WHERE status = $3 AND (campaignid, batch) =
+			(SELECT campaignid, batch FROM smsqueue WHERE status = $3 ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED)
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, campaignid, batch, COALESCE(provider, ''), msisdn, message, originator`,
+		processing, time.Now().UTC(), Queued)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	qb := &queuedBatch{}
+	for rows.Next() {
+		var id, cID int64
+		var n string
+		if err := rows.Scan(&id, &cID, &qb.Batch, &qb.Provider, &n, &qb.Message, &qb.Originator); err != nil {
+			return nil, err
+		}
+		qb.CampaignID = strconv.FormatInt(cID, 10)
+		qb.IDs = append(qb.IDs, id)
+		qb.MSISDNs = append(qb.MSISDNs, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(qb.IDs) == 0 {
+		return nil, nil
+	}
+	return qb, nil
+}
+
+// CompleteQueuedBatch marks the queue entries of a batch as sent, and links them
+// to the sendlog entry that was created for the batch.
+func (x *sqlNotifyDB) completeQueuedBatch(qb *queuedBatch, sendLogID string) error {
+	_, err := x.db.Exec(`UPDATE smsqueue SET status = $1, sendlogid = $2 WHERE id = ANY($3)`,
+		done, sendLogID, pq.Array(qb.IDs))
+	return err
+}
+
+// RequeueProcessing recovers queue entries that were claimed but never
+// completed, because the service was stopped while sending them, or the batch
+// could not be completed.  Entries that were already sent, according to the
+// messages recorded for their batch, are completed.  Other entries are returned
+// to the queue if they were claimed before the given time, since entries claimed
+// more recently may still be busy being sent by another instance of the service.
+// Entries in held are being sent by this instance, and are left alone.  The
+// campaigns of the completed entries are returned along with the number of
+// entries that were returned to the queue.
+func (x *sqlNotifyDB) requeueProcessing(claimedBefore time.Time, held []int64) ([]string, int64, error) {
+	if held == nil {
+		held = []int64{} // A NULL array would not match any entry
+	}
+	tx, err := x.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`UPDATE smsqueue SET status = $1, sendlogid = sent.sendlogid
+		FROM (SELECT sms.msisdn, sms.sendlogid, sendlog.campaignid, sendlog.batch
+			FROM sms JOIN sendlog ON sendlog.id = sms.sendlogid) sent
+		WHERE smsqueue.status = $2 AND NOT smsqueue.id = ANY($3)
+			AND sent.campaignid = smsqueue.campaignid AND sent.batch = smsqueue.batch AND sent.msisdn = smsqueue.msisdn
+		RETURNING smsqueue.campaignid`, done, processing, pq.Array(held))
+	if err != nil {
+		return nil, 0, err
+	}
+	var cIDs []string
+	fnd := map[string]bool{}
+	for rows.Next() {
+		var cID string
+		if err := rows.Scan(&cID); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		if !fnd[cID] {
+			fnd[cID] = true
+			cIDs = append(cIDs, cID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	r, err := tx.Exec(`UPDATE smsqueue SET status = $1 WHERE status = $2 AND processedtime < $3 AND NOT id = ANY($4)`,
+		Queued, processing, claimedBefore.UTC(), pq.Array(held))
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return nil, 0, err
+	}
+	return cIDs, n, tx.Commit()
+}
+
+// FinalizeCampaign records the outcome of a queued campaign once none of its
+// messages remain in the queue.
+func (x *sqlNotifyDB) finalizeCampaign(campaignID string) error {
+	var pending, batches, failed int
+	err := x.db.QueryRow(`SELECT COUNT(*) FROM smsqueue WHERE campaignid = $1 AND status <> $2`, campaignID, done).Scan(&pending)
+	if err != nil || pending > 0 {
+		return err
+	}
+	err = x.db.QueryRow(`SELECT COUNT(*), COUNT(*) FILTER (WHERE status = 'failed') FROM sendlog WHERE campaignid = $1`,
+		campaignID).Scan(&batches, &failed)
+	if err != nil {
+		return err
+	}
+	st, stDesc := "success", ""
+	if failed > 0 {
+		st, stDesc = "failed", fmt.Sprintf("%v of %v batches failed", failed, batches)
+	}
+	_, err = x.db.Exec(`UPDATE campaign SET failedbatches = $1, status = $2, description = $3 WHERE id = $4 AND status = $5`,
+		failed, st, stDesc, campaignID, Queued)
+	return err
+}
+
+// GetCampaignStatus retrieves a campaign along with the outcome of each of the
+// batches that have been sent so far.
+func (x *sqlNotifyDB) getCampaignStatus(campaignID string) (CampaignStatus, error) {
+	cs := CampaignStatus{RefNumber: campaignID}
+	err := x.db.QueryRow(`SELECT status, description, quantity FROM campaign WHERE id = $1`, campaignID).Scan(
+		&cs.Status, &cs.StatusDescription, &cs.Quantity)
+	if err != nil {
+		return cs, errors.New("GetCampaignStatus: Could not find campaign")
+	}
+	err = x.db.QueryRow(`SELECT COUNT(*) FROM smsqueue WHERE campaignid = $1 AND status <> $2`, campaignID, done).Scan(&cs.Queued)
+	if err != nil {
+		return cs, errors.New("GetCampaignStatus: Could not retrieve queue")
+	}
+
+	var last pq.NullTime
+	err = x.db.QueryRow(`SELECT MAX(sms.statustimestamp) FROM sms JOIN sendlog ON sendlog.id = sms.sendlogid
+		WHERE sendlog.campaignid = $1`, campaignID).Scan(&last)
+	if err != nil {
+		return cs, errors.New("GetCampaignStatus: Could not retrieve messages")
+	}
+	if last.Valid {
+		cs.LastStatusTime = &last.Time
+	}
+
+	rows, err := x.db.Query(`SELECT id, batch, COALESCE(provider, ''), quantity, status, description,
+		(SELECT COUNT(*) FROM sendattempt WHERE sendattempt.sendlogid = sendlog.id),
+		COALESCE(delivered, 0), COALESCE(failed, 0), COALESCE(sent, 0)
+		FROM sendlog WHERE campaignid = $1 ORDER BY batch`, campaignID)
+	if err != nil {
+		return cs, errors.New("GetCampaignStatus: Could not retrieve batches")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var br BatchResult
+		var st string
+		var delivered, failed, sent int
+		if err := rows.Scan(&br.SendLogID, &br.Batch, &br.Provider, &br.Recipients, &st, &br.StatusDescription, &br.Attempts,
+			&delivered, &failed, &sent); err != nil {
+			return cs, errors.New("GetCampaignStatus: Could not retrieve batches")
+		}
+		br.SendSuccess = st == "success"
+		cs.Batches = append(cs.Batches, br)
+		cs.Delivered += delivered
+		cs.Failed += failed
+		cs.Sent += sent
+	}
+	return cs, rows.Err()
+}
+
+// CreateTemplate stores the body as the next version of the named template
+func (x *sqlNotifyDB) createTemplate(name, body, email string) (Template, error) {
+	t := Template{Name: name, Body: body, CreatedBy: email, CreatedTime: time.Now().UTC()}
+	err := x.db.QueryRow(`INSERT INTO template (name, version, body, createdby, createdtime, deleted)
+		SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, false FROM template WHERE name = $1
+		RETURNING version`, name, body, email, t.CreatedTime).Scan(&t.Version)
+	if err != nil {
+		return t, errors.New("CreateTemplate: Could not store template")
+	}
+	return t, nil
+}
+
+// GetTemplate retrieves a version of a template that has not been deleted, or
+// its latest version if version is 0.
+func (x *sqlNotifyDB) getTemplate(name string, version int) (Template, error) {
+	t := Template{Name: name}
+	err := x.db.QueryRow(`SELECT version, body, createdby, createdtime FROM template
+		WHERE name = $1 AND ($2 = 0 OR version = $2) AND NOT deleted
+		ORDER BY version DESC LIMIT 1`, name, version).Scan(&t.Version, &t.Body, &t.CreatedBy, &t.CreatedTime)
+	if err != nil {
+		return t, errors.New("GetTemplate: Could not find template")
+	}
+	return t, nil
+}
+
+// ListTemplates retrieves the latest version of every template, or every
+// version of the named template if name is not empty.
+func (x *sqlNotifyDB) listTemplates(name string) ([]Template, error) {
+	q := `SELECT DISTINCT ON (name) name, version, body, createdby, createdtime FROM template
+		WHERE NOT deleted ORDER BY name, version DESC`
+	args := []interface{}{}
+	if name != "" {
+		q = `SELECT name, version, body, createdby, createdtime FROM template
+			WHERE name = $1 AND NOT deleted ORDER BY version DESC`
+		args = append(args, name)
+	}
+	rows, err := x.db.Query(q, args...)
+	if err != nil {
+		return nil, errors.New("ListTemplates: Could not retrieve templates")
+	}
+	defer rows.Close()
+	ts := []Template{}
+	for rows.Next() {
+		var t Template
+		if err := rows.Scan(&t.Name, &t.Version, &t.Body, &t.CreatedBy, &t.CreatedTime); err != nil {
+			return nil, errors.New("ListTemplates: Could not retrieve templates")
+		}
+		t.Variables = templateVariables(t.Body)
+		ts = append(ts, t)
+	}
+	return ts, rows.Err()
+}
+
+// DeleteTemplate marks every version of a template as deleted.  The rows are
+// kept, since campaigns that were sent from the template still refer to them.
+func (x *sqlNotifyDB) deleteTemplate(name string) error {
+	res, err := x.db.Exec(`UPDATE template SET deleted = true WHERE name = $1 AND NOT deleted`, name)
+	if err != nil {
+		return errors.New("DeleteTemplate: Could not delete template")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("DeleteTemplate: Could not find template")
+	}
+	return nil
+}
+
+// SetCampaignTemplate records the template that a campaign was sent from
+func (x *sqlNotifyDB) setCampaignTemplate(campaignID, name string, version int) error {
+	_, err := x.db.Exec(`UPDATE campaign SET template = $1, templateversion = $2 WHERE id = $3`, name, version, campaignID)
+	return err
+}
+
+const scheduleColumns = `id, sendat, timezone, status, description, COALESCE(priority, ''), originator, message,
+	template, templateversion, recipients, COALESCE(campaignid::VARCHAR, ''), createdtime`
+
+func scanSchedule(row interface {
+	Scan(...interface{}) error
+}) (ScheduledSend, error) {
+	var ss ScheduledSend
+	err := row.Scan(&ss.ID, &ss.SendAt, &ss.TimeZone, &ss.Status, &ss.StatusDescription, &ss.Priority, &ss.Originator, &ss.Message,
+		&ss.Template, &ss.TemplateVersion, &ss.Recipients, &ss.RefNumber, &ss.CreatedTime)
+	return ss, err
+}
+
+// CreateSchedule stores a scheduled send along with its rendered messages, and returns its ID.
+func (x *sqlNotifyDB) createSchedule(ss ScheduledSend) (string, error) {
+	msgs, err := json.Marshal(ss.messages)
+	if err != nil {
+		return "", err
+	}
+	var id int
+	err = x.db.QueryRow(`INSERT INTO schedule
+		(createdtime, sendat, timezone, status, description, originator, message, template, templateversion, recipients, messages, priority)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`,
+		ss.CreatedTime, ss.SendAt, ss.TimeZone, ss.Status, "", ss.Originator, ss.Message, ss.Template, ss.TemplateVersion,
+		ss.Recipients, string(msgs), ss.Priority).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(id), nil
+}
+
+// GetSchedule retrieves a scheduled send, without its messages
+func (x *sqlNotifyDB) getSchedule(id string) (ScheduledSend, error) {
+	ss, err := scanSchedule(x.db.QueryRow(`SELECT `+scheduleColumns+` FROM schedule WHERE id = $1`, id))
+	if err != nil {
+		return ss, errors.New("GetSchedule: Could not find scheduled send")
+	}
+	return ss, nil
+}
+
+// ListSchedules retrieves the scheduled sends with the given status, or all of
+// them if status is empty, ordered by delivery time.
+func (x *sqlNotifyDB) listSchedules(status string) ([]ScheduledSend, error) {
+	rows, err := x.db.Query(`SELECT `+scheduleColumns+` FROM schedule
+		WHERE $1 = '' OR status = $1 ORDER BY sendat, id`, status)
+	if err != nil {
+		return nil, errors.New("ListSchedules: Could not retrieve scheduled sends")
+	}
+	defer rows.Close()
+	sss := []ScheduledSend{}
+	for rows.Next() {
+		ss, err := scanSchedule(rows)
+		if err != nil {
+			return nil, errors.New("ListSchedules: Could not retrieve scheduled sends")
+		}
+		sss = append(sss, ss)
+	}
+	return sss, rows.Err()
+}
+
+// Reschedule changes the delivery time of a scheduled send that is still pending
+func (x *sqlNotifyDB) reschedule(id string, sendAt time.Time, timeZone string) error {
+	res, err := x.db.Exec(`UPDATE schedule SET sendat = $1, timezone = $2 WHERE id = $3 AND status = $4`,
+		sendAt, timeZone, id, schedulePending)
+	if err != nil {
+		return errors.New("Reschedule: Could not update scheduled send")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Reschedule: Could not find pending scheduled send")
+	}
+	return nil
+}
+
+// GetScheduleMessages retrieves the messages of a scheduled send
+func (x *sqlNotifyDB) getScheduleMessages(id string) ([]RecipientMessage, error) {
+	var msgs string
+	if err := x.db.QueryRow(`SELECT messages FROM schedule WHERE id = $1`, id).Scan(&msgs); err != nil {
+		return nil, errors.New("GetScheduleMessages: Could not find scheduled send")
+	}
+	var rms []RecipientMessage
+	if err := json.Unmarshal([]byte(msgs), &rms); err != nil {
+		return nil, errors.New("GetScheduleMessages: Could not read messages")
+	}
+	return rms, nil
+}
+
+// CancelSchedule cancels a scheduled send that is still pending
+func (x *sqlNotifyDB) cancelSchedule(id string) error {
+	res, err := x.db.Exec(`UPDATE schedule SET status = $1 WHERE id = $2 AND status = $3`,
+		scheduleCancelled, id, schedulePending)
+	if err != nil {
+		return errors.New("CancelSchedule: Could not update scheduled send")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("CancelSchedule: Could not find pending scheduled send")
+	}
+	return nil
+}
+
+// ClaimDueSchedule marks the earliest pending send that is due as being
+// processed, and returns it along with its messages.  It returns nil if no send
+// is due.  Rows that are locked by another instance of the service are skipped.
+func (x *sqlNotifyDB) claimDueSchedule(now time.Time) (*ScheduledSend, error) {
+	var msgs string
+	var ss ScheduledSend
+	err := x.db.QueryRow(`UPDATE schedule SET status = $1, processedtime = $2
+		WHERE id = (SELECT id FROM schedule WHERE status = $3 AND sendat <= $2 ORDER BY sendat, id LIMIT 1 FOR UPDATE SKIP LOCKED)
+		RETURNING id, sendat, timezone, status, COALESCE(priority, ''), originator, message, template, templateversion, recipients, messages, createdtime`,
+		processing, now, schedulePending).Scan(&ss.ID, &ss.SendAt, &ss.TimeZone, &ss.Status, &ss.Priority, &ss.Originator, &ss.Message,
+		&ss.Template, &ss.TemplateVersion, &ss.Recipients, &msgs, &ss.CreatedTime)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(msgs), &ss.messages); err != nil {
+		return nil, err
+	}
+	return &ss, nil
+}
+
+// CompleteSchedule records the outcome of a scheduled send, and the campaign that it created
+func (x *sqlNotifyDB) completeSchedule(id, status, description, campaignID string) error {
+	var cID interface{}
+	if campaignID != "" {
+		cID = campaignID
+	}
+	_, err := x.db.Exec(`UPDATE schedule SET status = $1, description = $2, campaignid = $3 WHERE id = $4`,
+		status, description, cID, id)
+	return err
+}
+
+// FailInterruptedSchedules marks sends that were claimed before the given time
+// and are still being processed as failed, since the service was stopped while
+// processing them.  They are not retried, since some of their messages may
+// already have been sent.  Sends claimed more recently may still be busy being
+// sent by another instance of the service.
+func (x *sqlNotifyDB) failInterruptedSchedules(claimedBefore time.Time) (int64, error) {
+	res, err := x.db.Exec(`UPDATE schedule SET status = $1, description = $2 WHERE status = $3 AND processedtime < $4`,
+		scheduleFailed, "Interrupted by a restart of the service", processing, claimedBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// AddSuppression adds a number to the suppression list, or replaces its entry
+func (x *sqlNotifyDB) addSuppression(sup Suppression) error {
+	_, err := x.db.Exec(`INSERT INTO suppression (msisdn, reason, source, createdby, createdtime)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (msisdn) DO UPDATE SET reason = $2, source = $3, createdby = $4, createdtime = $5`,
+		sup.MSISDN, sup.Reason, sup.Source, sup.CreatedBy, sup.CreatedTime)
+	if err != nil {
+		return errors.New("AddSuppression: Could not add number")
+	}
+	return nil
+}
+
+// RemoveSuppression removes a number from the suppression list
+func (x *sqlNotifyDB) removeSuppression(msisdn string) error {
+	res, err := x.db.Exec(`DELETE FROM suppression WHERE msisdn = $1`, msisdn)
+	if err != nil {
+		return errors.New("RemoveSuppression: Could not remove number")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("RemoveSuppression: Could not find number")
+	}
+	return nil
+}
+
+// ListSuppressions retrieves the suppression list, most recent first
+func (x *sqlNotifyDB) listSuppressions() ([]Suppression, error) {
+	rows, err := x.db.Query(`SELECT msisdn, reason, source, createdby, createdtime FROM suppression ORDER BY createdtime DESC, msisdn`)
+	if err != nil {
+		return nil, errors.New("ListSuppressions: Could not retrieve numbers")
+	}
+	defer rows.Close()
+	sups := []Suppression{}
+	for rows.Next() {
+		var sup Suppression
+		if err := rows.Scan(&sup.MSISDN, &sup.Reason, &sup.Source, &sup.CreatedBy, &sup.CreatedTime); err != nil {
+			return nil, errors.New("ListSuppressions: Could not retrieve numbers")
+		}
+		sups = append(sups, sup)
+	}
+	return sups, rows.Err()
+}
+
+// SuppressedNumbers returns the numbers that are on the suppression list
+func (x *sqlNotifyDB) suppressedNumbers(ns []string) (map[string]bool, error) {
+	rows, err := x.db.Query(`SELECT msisdn FROM suppression WHERE msisdn = ANY($1)`, pq.Array(ns))
+	if err != nil {
+		return nil, errors.New("SuppressedNumbers: Could not check numbers")
+	}
+	defer rows.Close()
+	sup := map[string]bool{}
+	for rows.Next() {
+		var n string
+		if err := rows.Scan(&n); err != nil {
+			return nil, errors.New("SuppressedNumbers: Could not check numbers")
+		}
+		sup[n] = true
+	}
+	return sup, rows.Err()
+}
+
+// UpdateCampaign records the final outcome of a campaign once all of its batches have been sent.
+func (x *sqlNotifyDB) updateCampaign(campaignID string, failedBatches int, status, statusDescription string) error {
+	_, err := x.db.Exec(`UPDATE campaign SET failedbatches = $1, status = $2, description = $3 WHERE id = $4`,
+		failedBatches, status, statusDescription, campaignID)
+	return err
+}
+
 // CreateSMSData handles the DB entries for batch as well as individual
 // messages after sending.
-func (x *sqlNotifyDB) createSMSData(messageText, email string, messages []SendSMSResponseMessage, err error) (string, error) {
+func (x *sqlNotifyDB) createSMSData(messageText, email, campaignID string, batch int, provider, encoding string, messages []SendSMSResponseMessage, err error) (string, error) {
 	var st, stDesc string
 	if err != nil {
 		st = "failed"
@@ -29,22 +567,26 @@ func (x *sqlNotifyDB) createSMSData(messageText, email string, messages []SendSM
 	var id int
 	// Create entry in the batchlog table and retrieve the new row ID.
 	err = x.db.QueryRow(`INSERT INTO sendlog 
-		(senttime, originator, type, quantity, delivered, failed, sent, message, status, description) 
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
-		time.Now().UTC(), email, "sms", len(messages), 0, 0, len(messages), messageText, st, stDesc).Scan(&id)
+		(senttime, originator, type, quantity, delivered, failed, sent, message, status, description, campaignid, batch, provider) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id`,
+		time.Now().UTC(), email, channelSMS, len(messages), 0, 0, len(messages), messageText, st, stDesc, campaignID, batch, provider).Scan(&id)
 	if err != nil {
 		return "", err
 	}
 	// Add a new entry in the sendtransaction table for each of the SMS messages.
 	for i := 0; i < len(messages); i++ {
-		msgStatus := Sent
-		if messages[i].ErrorCode != "0" {
-			msgStatus = messages[i].ErrorCode
-		}
-		_, err := x.db.Exec(`INSERT INTO sms
-			(msisdn, senttime, segments, sendlogid, status, message, providerid)
-			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-			messages[i].To, time.Now().UTC(), messages[i].Segments, id, msgStatus, messageText, messages[i].MessageID)
+		msgStatus, msgDesc := Sent, ""
+		if !messages[i].sent() {
+			msgStatus, msgDesc = messages[i].ErrorCode, messages[i].ErrorDesc
+		}
+		// The status that the message was sent with starts its timeline
+		_, err := x.db.Exec(`WITH m AS (INSERT INTO sms
+			(msisdn, senttime, segments, sendlogid, status, message, providerid, provider, encoding, statusdescription)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id, providerid)
+			INSERT INTO statusevent (smsid, providerid, rawcode, status, description, source, eventtime)
+			SELECT id, providerid, $11, $5, $10, $12, $2 FROM m`,
+			messages[i].To, time.Now().UTC(), messages[i].Segments, id, msgStatus, messageText, messages[i].MessageID, provider, encoding, msgDesc,
+			messages[i].ErrorCode, statusSourceSend)
 		if err != nil {
 			return "", err
 		}
@@ -52,46 +594,499 @@ func (x *sqlNotifyDB) createSMSData(messageText, email string, messages []SendSM
 	return strconv.Itoa(id), nil
 }
 
-// UpdateSMSData updates the SMS transaction with the retrieved status and timestamp.
-func (x *sqlNotifyDB) updateSMSData(messageID, statusCode, statusDescription, sendLogID string, segments int) (err error) {
-	if statusCode != Sent {
-		_, err := x.db.Exec(`UPDATE sms SET status = $1, statustimestamp = $2, segments = $3 WHERE providerid = $4;`,
-			statusCode, time.Now().UTC(), segments, messageID)
+// CreateSendAttempts records every attempt that was made to send a batch to the provider.
+func (x *sqlNotifyDB) createSendAttempts(sendLogID string, attempts []sendAttempt) error {
+	for _, a := range attempts {
+		_, err := x.db.Exec(`INSERT INTO sendattempt (sendlogid, attempt, attempttime, errorcode, description)
+			VALUES ($1, $2, $3, $4, $5)`, sendLogID, a.Attempt, a.Time, a.ErrorCode, a.Description)
 		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	if statusCode == Delivered { // Success
-		_, err := x.db.Exec(`UPDATE sendlog SET delivered = delivered + 1, sent = sent - 1 WHERE id = $1`, sendLogID)
+// CreateEmailData creates the sendlog entry for a batch of emails, and an entry
+// in the email table for each recipient.  Emails have no delivery receipts, so
+// the sendlog counts emails that were accepted by the SMTP server as delivered.
+func (x *sqlNotifyDB) createEmailData(subject, email, campaignID string, batch int, messages []SendSMSResponseMessage, err error) (string, error) {
+	st, stDesc := "success", ""
+	if err != nil {
+		st, stDesc = "failed", err.Error()
+	}
+	delivered := 0
+	for _, m := range messages {
+		if m.sent() {
+			delivered++
+		}
+	}
+
+	var id int
+	now := time.Now().UTC()
+	err = x.db.QueryRow(`INSERT INTO sendlog
+		(senttime, originator, type, quantity, delivered, failed, sent, message, status, description, campaignid, batch)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`,
+		now, email, channelEmail, len(messages), delivered, len(messages)-delivered, 0, subject, st, stDesc, campaignID, batch).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range messages {
+		mst, mDesc := Delivered, ""
+		if !m.sent() {
+			mst, mDesc = Failed, m.ErrorDesc
+		}
+		_, err := x.db.Exec(`INSERT INTO email (address, senttime, sendlogid, status, subject, messageid, description)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`, m.To, now, id, mst, subject, m.MessageID, mDesc)
+		if err != nil {
+			return "", err
+		}
+	}
+	return strconv.Itoa(id), nil
+}
+
+// UpdateSMSData updates the SMS transaction with the retrieved status and timestamp.
+// Messages that already have a final status are not updated again, so that
+// the sendlog totals are not counted twice when a status is both polled and
+// pushed by the provider.  Every status is recorded in the message's timeline,
+// along with the provider's own code and where it came from, unless it is the
+// same as the previous status in the timeline.  The timeline and the totals
+// are updated in one transaction, so that they cannot disagree.
+func (x *sqlNotifyDB) updateSMSData(messageID, statusCode, statusDescription, rawCode, source, sendLogID string, segments int) (err error) {
+	if rawCode == "" {
+		rawCode = statusCode
+	}
+	tx, err := x.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO statusevent (smsid, providerid, rawcode, status, description, source, eventtime)
+		SELECT sms.id, sms.providerid, $2, $3, $4, $5, $6 FROM sms WHERE sms.providerid = $1 AND NOT EXISTS (
+			SELECT 1 FROM statusevent e WHERE e.id = (SELECT MAX(id) FROM statusevent WHERE smsid = sms.id)
+			AND e.rawcode = $2 AND e.status = $3)`,
+		messageID, rawCode, statusCode, statusDescription, source, time.Now().UTC())
+	if err != nil {
 		return err
+	}
+
+	if statusCode == Sent {
+		return tx.Commit() // no final status available yet
+	}
+
+	// Receipts that don't report the number of segments keep the number recorded when sending
+	r, err := tx.Exec(`UPDATE sms SET status = $1, statustimestamp = $2, segments = COALESCE(NULLIF($3, 0), segments), 
+		statusdescription = $7 WHERE providerid = $4 AND status NOT IN ($5, $6);`,
+		statusCode, time.Now().UTC(), segments, messageID, Delivered, Failed, statusDescription)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return tx.Commit()
+	}
+
+	if statusCode == Delivered { // Success
+		_, err = tx.Exec(`UPDATE sendlog SET delivered = delivered + 1, sent = sent - 1 WHERE id = $1`, sendLogID)
 	} else if statusCode == Failed {
-		_, err := x.db.Exec(`UPDATE sendlog SET failed = failed + 1, sent = sent - 1 WHERE id = $1`, sendLogID)
+		_, err = tx.Exec(`UPDATE sendlog SET failed = failed + 1, sent = sent - 1 WHERE id = $1`, sendLogID)
+	}
+	if err != nil {
 		return err
 	}
-	return err
+	return tx.Commit()
+}
+
+// errUnknownMessage is returned by getSendLogID if no message has the provider ID
+var errUnknownMessage = errors.New("GetSendLogID: Could not find message")
 
+// GetSendLogID finds the sendlog entry of the message with the given provider ID.
+func (x *sqlNotifyDB) getSendLogID(messageID string) (sendLogID string, err error) {
+	err = x.db.QueryRow(`SELECT sendlogid FROM sms WHERE providerid = $1`, messageID).Scan(&sendLogID)
+	if err == sql.ErrNoRows {
+		return "", errUnknownMessage
+	}
+	if err != nil {
+		return "", errors.New("GetSendLogID: Could not retrieve message")
+	}
+	return sendLogID, nil
 }
 
 // GetLastSMSID finds the most recent message that was sent to a specific
-// mobile number and returns the messageID.
-func (x *sqlNotifyDB) getLastSMSID(m string) (messageID, sendLogID, status string, err error) {
-	err = x.db.QueryRow(`SELECT providerid, sendlogid, status FROM sms WHERE msisdn = $1 ORDER BY senttime DESC LIMIT 1`, m).Scan(&messageID, &sendLogID, &status)
+// mobile number and returns the messageID and the provider it was sent through.
+func (x *sqlNotifyDB) getLastSMSID(m string) (messageID, sendLogID, provider, status string, err error) {
+	err = x.db.QueryRow(`SELECT providerid, sendlogid, COALESCE(provider, ''), status FROM sms WHERE msisdn = $1 ORDER BY senttime DESC LIMIT 1`,
+		m).Scan(&messageID, &sendLogID, &provider, &status)
+	if err != nil {
+		return "", "", "", "", errors.New("GetLastSMSID: Could not find messageID")
+	}
+	return messageID, sendLogID, provider, status, nil
+}
+
+// GetLastSMSRowID finds the ID of the most recent sms row for a number
+func (x *sqlNotifyDB) getLastSMSRowID(m string) (string, error) {
+	var id string
+	err := x.db.QueryRow(`SELECT id FROM sms WHERE msisdn = $1 ORDER BY senttime DESC, id DESC LIMIT 1`, m).Scan(&id)
 	if err != nil {
-		return "", "", "", errors.New("GetLastSMSID: Could not find messageID")
+		return "", errors.New("GetLastSMSRowID: Could not find message")
 	}
-	return messageID, sendLogID, status, nil
+	return id, nil
+}
+
+// CreateInbound stores a reply, and returns its ID.  A reply that was already
+// stored, identified by the provider's message ID, is not stored again.
+func (x *sqlNotifyDB) createInbound(in InboundSMS) (string, error) {
+	var smsID interface{}
+	if in.SMSID != "" {
+		smsID = in.SMSID
+	}
+	var id int
+	err := x.db.QueryRow(`INSERT INTO inbound (msisdn, recipient, message, receivedtime, provider, providerid, smsid, keyword)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (provider, providerid) WHERE providerid <> '' DO NOTHING RETURNING id`,
+		in.MSISDN, in.To, in.Message, in.ReceivedTime, in.Provider, in.ProviderID, smsID, in.Keyword).Scan(&id)
+	if err == sql.ErrNoRows {
+		// The provider delivered the reply again, because handling it failed the first time
+		err = x.db.QueryRow(`SELECT id FROM inbound WHERE provider = $1 AND providerid = $2`, in.Provider, in.ProviderID).Scan(&id)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(id), nil
+}
+
+// ListInbound retrieves the most recent replies, optionally only those from one number
+func (x *sqlNotifyDB) listInbound(msisdn string, limit int) ([]InboundSMS, error) {
+	rows, err := x.db.Query(`SELECT id, msisdn, recipient, message, receivedtime, provider, providerid,
+		COALESCE(smsid::VARCHAR, ''), keyword FROM inbound
+		WHERE $1 = '' OR msisdn = $1 ORDER BY receivedtime DESC, id DESC LIMIT $2`, msisdn, limit)
+	if err != nil {
+		return nil, errors.New("ListInbound: Could not retrieve replies")
+	}
+	defer rows.Close()
+	ins := []InboundSMS{}
+	for rows.Next() {
+		var in InboundSMS
+		if err := rows.Scan(&in.ID, &in.MSISDN, &in.To, &in.Message, &in.ReceivedTime, &in.Provider, &in.ProviderID, &in.SMSID, &in.Keyword); err != nil {
+			return nil, errors.New("ListInbound: Could not retrieve replies")
+		}
+		ins = append(ins, in)
+	}
+	return ins, rows.Err()
+}
+
+const sendLogColumns = `id, COALESCE(campaignid::VARCHAR, ''), COALESCE(batch, 0), senttime, COALESCE(originator, ''),
+	COALESCE(type, ''), COALESCE(provider, ''), quantity, delivered, failed, sent, COALESCE(message, ''),
+	COALESCE(status, ''), COALESCE(description, '')`
+
+func scanSendLog(row interface {
+	Scan(...interface{}) error
+}) (SendLogEntry, error) {
+	var e SendLogEntry
+	err := row.Scan(&e.ID, &e.RefNumber, &e.Batch, &e.SentTime, &e.Originator, &e.Type, &e.Provider, &e.Quantity,
+		&e.Delivered, &e.Failed, &e.Sent, &e.Message, &e.Status, &e.Description)
+	return e, err
+}
+
+// ListSendLogs retrieves up to limit sendlog entries that match the query, in
+// the sort order of the query, starting after its cursor.
+func (x *sqlNotifyDB) listSendLogs(q HistoryQuery, limit int) ([]SendLogEntry, error) {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if q.Originator != "" {
+		where = append(where, "originator = "+arg(q.Originator))
+	}
+	if !q.From.IsZero() {
+		where = append(where, "senttime >= "+arg(q.From))
+	}
+	if !q.To.IsZero() {
+		where = append(where, "senttime < "+arg(q.To))
+	}
+	if q.Status != "" {
+		where = append(where, "status = "+arg(q.Status))
+	}
+	if q.Type != "" {
+		where = append(where, "type = "+arg(q.Type))
+	}
+	if q.Message != "" {
+		esc := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q.Message)
+		where = append(where, "message ILIKE "+arg("%"+esc+"%"))
+	}
+
+	col := historySorts[q.Sort]
+	cast, cmp, dir := "INTEGER", ">", "ASC"
+	if col == "senttime" {
+		cast = "TIMESTAMP"
+	}
+	if !q.Ascending {
+		cmp, dir = "<", "DESC"
+	}
+	if q.After != nil {
+		where = append(where, fmt.Sprintf("(%v, id) %v (%v::%v, %v)", col, cmp, arg(q.After.Value), cast, arg(q.After.ID)))
+	}
+
+	query := `SELECT ` + sendLogColumns + ` FROM sendlog`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %v %v, id %v LIMIT %v", col, dir, dir, arg(limit))
+
+	rows, err := x.db.Query(query, args...)
+	if err != nil {
+		return nil, errors.New("ListSendLogs: Could not retrieve sends")
+	}
+	defer rows.Close()
+	es := []SendLogEntry{}
+	for rows.Next() {
+		e, err := scanSendLog(rows)
+		if err != nil {
+			return nil, errors.New("ListSendLogs: Could not retrieve sends")
+		}
+		es = append(es, e)
+	}
+	return es, rows.Err()
+}
+
+// GetSendLog retrieves a sendlog entry along with each of its messages
+func (x *sqlNotifyDB) getSendLog(id string) (SendLogDetail, error) {
+	var d SendLogDetail
+	var err error
+	d.SendLogEntry, err = scanSendLog(x.db.QueryRow(`SELECT `+sendLogColumns+` FROM sendlog WHERE id = $1`, id))
+	if err != nil {
+		return d, errors.New("GetSendLog: Could not find send")
+	}
+
+	q := `SELECT id, msisdn, senttime, COALESCE(segments, 0), COALESCE(status, ''), statustimestamp,
+		COALESCE(providerid, ''), COALESCE(provider, ''), COALESCE(encoding, ''), '' FROM sms WHERE sendlogid = $1 ORDER BY id`
+	if d.Type == channelEmail {
+		q = `SELECT id, address, senttime, 0, COALESCE(status, ''), NULL::TIMESTAMP,
+			COALESCE(messageid, ''), '', '', COALESCE(description, '') FROM email WHERE sendlogid = $1 ORDER BY id`
+	}
+	rows, err := x.db.Query(q, id)
+	if err != nil {
+		return d, errors.New("GetSendLog: Could not retrieve messages")
+	}
+	defer rows.Close()
+	d.Messages = []SendLogMessage{}
+	for rows.Next() {
+		var m SendLogMessage
+		var st pq.NullTime
+		if err := rows.Scan(&m.ID, &m.To, &m.SentTime, &m.Segments, &m.Status, &st, &m.ProviderID, &m.Provider, &m.Encoding, &m.Description); err != nil {
+			return d, errors.New("GetSendLog: Could not retrieve messages")
+		}
+		if st.Valid {
+			m.StatusTime = &st.Time
+		}
+		d.Messages = append(d.Messages, m)
+	}
+	return d, rows.Err()
+}
+
+const messageStatusColumns = `sms.id, sms.msisdn, COALESCE(sendlog.campaignid::VARCHAR, ''), sms.sendlogid,
+	COALESCE(sms.provider, ''), COALESCE(sms.providerid, ''), COALESCE(sms.status, ''), COALESCE(sms.statusdescription, ''),
+	COALESCE(sms.segments, 0), sms.senttime, sms.statustimestamp
+	FROM sms LEFT JOIN sendlog ON sendlog.id = sms.sendlogid`
+
+func scanMessageStatus(row *sql.Row) (MessageStatus, error) {
+	var ms MessageStatus
+	var st pq.NullTime
+	err := row.Scan(&ms.ID, &ms.MSISDN, &ms.RefNumber, &ms.SendLogID, &ms.Provider, &ms.ProviderID, &ms.Status,
+		&ms.StatusDescription, &ms.Segments, &ms.SentTime, &st)
+	if st.Valid {
+		ms.StatusTime = &st.Time
+	}
+	return ms, err
+}
+
+// GetMessageStatus retrieves the status of the message with the provider's message ID
+func (x *sqlNotifyDB) getMessageStatus(providerID string) (MessageStatus, error) {
+	ms, err := scanMessageStatus(x.db.QueryRow(`SELECT `+messageStatusColumns+`
+		WHERE sms.providerid = $1 ORDER BY sms.id DESC LIMIT 1`, providerID))
+	if err != nil {
+		return ms, errors.New("GetMessageStatus: Could not find message")
+	}
+	return ms, nil
+}
+
+// GetMessageStatusByID retrieves the status of the message with the given sms ID
+func (x *sqlNotifyDB) getMessageStatusByID(id string) (MessageStatus, error) {
+	ms, err := scanMessageStatus(x.db.QueryRow(`SELECT `+messageStatusColumns+` WHERE sms.id = $1`, id))
+	if err != nil {
+		return ms, errors.New("GetMessageStatusByID: Could not find message")
+	}
+	return ms, nil
+}
+
+// ListStatusEvents retrieves every status that was received for a message, in the order received
+func (x *sqlNotifyDB) listStatusEvents(smsID string) ([]StatusEvent, error) {
+	rows, err := x.db.Query(`SELECT id, COALESCE(rawcode, ''), COALESCE(status, ''), COALESCE(description, ''),
+		COALESCE(source, ''), eventtime FROM statusevent WHERE smsid = $1 ORDER BY eventtime, id`, smsID)
+	if err != nil {
+		return nil, errors.New("ListStatusEvents: Could not retrieve the timeline")
+	}
+	defer rows.Close()
+	evs := []StatusEvent{}
+	for rows.Next() {
+		var ev StatusEvent
+		if err := rows.Scan(&ev.ID, &ev.RawCode, &ev.Status, &ev.Description, &ev.Source, &ev.Time); err != nil {
+			return nil, errors.New("ListStatusEvents: Could not retrieve the timeline")
+		}
+		evs = append(evs, ev)
+	}
+	return evs, rows.Err()
+}
+
+// GetLastMessageStatus retrieves the status of the most recent message sent to a number
+func (x *sqlNotifyDB) getLastMessageStatus(msisdn string) (MessageStatus, error) {
+	ms, err := scanMessageStatus(x.db.QueryRow(`SELECT `+messageStatusColumns+`
+		WHERE sms.msisdn = $1 ORDER BY sms.senttime DESC, sms.id DESC LIMIT 1`, msisdn))
+	if err != nil {
+		return ms, errors.New("GetLastMessageStatus: Could not find message")
+	}
+	return ms, nil
+}
+
+// CreateGroup stores a new recipient group, and returns its ID
+func (x *sqlNotifyDB) createGroup(g RecipientGroup) (string, error) {
+	var id int
+	err := x.db.QueryRow(`INSERT INTO recipientgroup (name, description, createdby, createdtime)
+		VALUES ($1, $2, $3, $4) RETURNING id`, g.Name, g.Description, g.CreatedBy, g.CreatedTime).Scan(&id)
+	if err != nil {
+		return "", errors.New("CreateGroup: Could not create group, the name may already be in use")
+	}
+	return strconv.Itoa(id), nil
+}
+
+const groupColumns = `id, name, description, createdby, createdtime,
+	(SELECT COUNT(*) FROM groupmember WHERE groupmember.groupid = recipientgroup.id)`
+
+// GetGroup retrieves a recipient group along with its number of members
+func (x *sqlNotifyDB) getGroup(id string) (RecipientGroup, error) {
+	var g RecipientGroup
+	err := x.db.QueryRow(`SELECT `+groupColumns+` FROM recipientgroup WHERE id = $1`, id).Scan(
+		&g.ID, &g.Name, &g.Description, &g.CreatedBy, &g.CreatedTime, &g.Members)
+	if err != nil {
+		return g, errors.New("GetGroup: Could not find group")
+	}
+	return g, nil
+}
+
+// ListGroups retrieves every recipient group, ordered by name
+func (x *sqlNotifyDB) listGroups() ([]RecipientGroup, error) {
+	rows, err := x.db.Query(`SELECT ` + groupColumns + ` FROM recipientgroup ORDER BY name`)
+	if err != nil {
+		return nil, errors.New("ListGroups: Could not retrieve groups")
+	}
+	defer rows.Close()
+	gs := []RecipientGroup{}
+	for rows.Next() {
+		var g RecipientGroup
+		if err := rows.Scan(&g.ID, &g.Name, &g.Description, &g.CreatedBy, &g.CreatedTime, &g.Members); err != nil {
+			return nil, errors.New("ListGroups: Could not retrieve groups")
+		}
+		gs = append(gs, g)
+	}
+	return gs, rows.Err()
+}
+
+// DeleteGroup deletes a recipient group and its members
+func (x *sqlNotifyDB) deleteGroup(id string) error {
+	tx, err := x.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM groupmember WHERE groupid = $1`, id); err != nil {
+		return errors.New("DeleteGroup: Could not delete members")
+	}
+	res, err := tx.Exec(`DELETE FROM recipientgroup WHERE id = $1`, id)
+	if err != nil {
+		return errors.New("DeleteGroup: Could not delete group")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("DeleteGroup: Could not find group")
+	}
+	return tx.Commit()
+}
+
+// AddGroupMembers adds the members to a group in a single transaction.  The
+// variables of existing members are replaced.
+func (x *sqlNotifyDB) addGroupMembers(groupID string, rs []Recipient) error {
+	tx, err := x.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO groupmember (groupid, msisdn, variables, addedtime) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (groupid, msisdn) DO UPDATE SET variables = $3`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	now := time.Now().UTC()
+	for _, r := range rs {
+		vs, err := json.Marshal(r.Variables)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(groupID, r.MSISDN, string(vs), now); err != nil {
+			return errors.New("AddGroupMembers: Could not add members")
+		}
+	}
+	return tx.Commit()
+}
+
+// RemoveGroupMember removes a number from a group
+func (x *sqlNotifyDB) removeGroupMember(groupID, msisdn string) error {
+	res, err := x.db.Exec(`DELETE FROM groupmember WHERE groupid = $1 AND msisdn = $2`, groupID, msisdn)
+	if err != nil {
+		return errors.New("RemoveGroupMember: Could not remove member")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("RemoveGroupMember: Could not find member")
+	}
+	return nil
+}
+
+// GroupMembers retrieves the members of the groups, ordered by the position of
+// their group in groupIDs and then by the order in which they were added.
+func (x *sqlNotifyDB) groupMembers(groupIDs []string) ([]Recipient, error) {
+	rows, err := x.db.Query(`SELECT msisdn, variables FROM groupmember WHERE groupid::VARCHAR = ANY($1)
+		ORDER BY array_position($1, groupid::VARCHAR), id`, pq.Array(groupIDs))
+	if err != nil {
+		return nil, errors.New("GroupMembers: Could not retrieve members")
+	}
+	defer rows.Close()
+	rs := []Recipient{}
+	for rows.Next() {
+		var r Recipient
+		var vs string
+		if err := rows.Scan(&r.MSISDN, &vs); err != nil {
+			return nil, errors.New("GroupMembers: Could not retrieve members")
+		}
+		if err := json.Unmarshal([]byte(vs), &r.Variables); err != nil {
+			return nil, errors.New("GroupMembers: Invalid member variables")
+		}
+		rs = append(rs, r)
+	}
+	return rs, rows.Err()
 }
 
 // GetUnresolvedIDs finds the vendorIDs for all of the sms messages that does
 // not have a valid status and that have been sent within the last period
-// as specified in the i variable (in minutes).
+// as specified in the i variable (in minutes).  Each entry contains the
+// vendorID, sendlogID and provider of a message.
 func (x *sqlNotifyDB) getUnresolvedIDs(s string) (vendorIDs [][]string, err error) {
 	d, err := time.ParseDuration(s)
 	if err != nil {
 		return vendorIDs, err
 	}
-	rows, err := x.db.Query(`SELECT providerid, sendlogid FROM sms WHERE statustimestamp IS NULL AND senttime >= $1`,
+	rows, err := x.db.Query(`SELECT providerid, sendlogid, COALESCE(provider, '') FROM sms WHERE statustimestamp IS NULL AND senttime >= $1`,
 		time.Now().UTC().Add(-d))
 	if err != nil {
 		return vendorIDs, errors.New("GetUnresolvedIDs: Could not retrieve messages")
@@ -99,12 +1094,12 @@ func (x *sqlNotifyDB) getUnresolvedIDs(s string) (vendorIDs [][]string, err erro
 	defer rows.Close()
 
 	for rows.Next() {
-		var aID, sLogID string
+		var aID, sLogID, pKey string
 		var comb []string
-		if err := rows.Scan(&aID, &sLogID); err != nil {
+		if err := rows.Scan(&aID, &sLogID, &pKey); err != nil {
 			return vendorIDs, errors.New("GetUnresolvedIDs: Could not retrieve messages")
 		}
-		vendorIDs = append(vendorIDs, append(comb, aID, sLogID))
+		vendorIDs = append(vendorIDs, append(comb, aID, sLogID, pKey))
 	}
 
 	if err := rows.Err(); err != nil {
@@ -157,7 +1152,8 @@ func (s *MessagingServer) runMigrations() error {
 // A new 'sendlog' entry is created in the table for each batch of messages that are submitted,
 // where the message is the same for all recipients. A new entry is created in the 'sms' table for
 // each message that is sent to a unique msisdn, and is linked to the 'sendlog' table by the
-// 'sendlogid' field.
+// 'sendlogid' field.  Each send request creates a 'campaign' entry, which all of the
+// 'sendlog' entries for its batches refer to by the 'campaignid' field.
 func createMigrations() []migration.Migrator {
 	var migrations []migration.Migrator
 
@@ -187,6 +1183,171 @@ func createMigrations() []migration.Migrator {
 			message VARCHAR,
 			providerid VARCHAR
 			)`,
+
+		`CREATE TABLE campaign (
+			id BIGSERIAL PRIMARY KEY,
+			senttime TIMESTAMP,
+			originator VARCHAR,
+			type VARCHAR,
+			quantity INTEGER,
+			batches INTEGER,
+			failedbatches INTEGER,
+			message VARCHAR,
+			status VARCHAR,
+			description VARCHAR
+		)`,
+
+		`ALTER TABLE sendlog ADD COLUMN campaignid BIGINT, ADD COLUMN batch INTEGER`,
+
+		// When the outbound queue is enabled, the recipients of a campaign wait here until the dispatcher sends their batch
+		`CREATE TABLE smsqueue (
+			id BIGSERIAL PRIMARY KEY,
+			campaignid BIGINT,
+			batch INTEGER,
+			msisdn VARCHAR,
+			message VARCHAR,
+			originator VARCHAR,
+			status VARCHAR,
+			queuedtime TIMESTAMP,
+			processedtime TIMESTAMP,
+			sendlogid BIGINT
+		)`,
+
+		`CREATE INDEX smsqueue_status_idx ON smsqueue (status, id)`,
+		`CREATE INDEX smsqueue_campaign_idx ON smsqueue (campaignid, batch)`,
+
+		// Every attempt to send a batch to the provider, including retries
+		`CREATE TABLE sendattempt (
+			id BIGSERIAL PRIMARY KEY,
+			sendlogid BIGINT,
+			attempt INTEGER,
+			attempttime TIMESTAMP,
+			errorcode VARCHAR,
+			description VARCHAR
+		)`,
+
+		// The configured provider that the messages were routed to
+		`ALTER TABLE sms ADD COLUMN provider VARCHAR`,
+		`ALTER TABLE sendlog ADD COLUMN provider VARCHAR`,
+		`ALTER TABLE smsqueue ADD COLUMN provider VARCHAR`,
+
+		// Emails are recorded in 'campaign' and 'sendlog' with the type 'email', with a row here per recipient
+		`CREATE TABLE email (
+			id BIGSERIAL PRIMARY KEY,
+			address VARCHAR,
+			senttime TIMESTAMP,
+			sendlogid BIGINT,
+			status VARCHAR,
+			subject VARCHAR,
+			messageid VARCHAR,
+			description VARCHAR
+		)`,
+
+		// Whether the message was sent in the GSM 7-bit alphabet or as UCS-2
+		`ALTER TABLE sms ADD COLUMN encoding VARCHAR`,
+
+		// A row per version of a template, and the template that a campaign was sent from
+		`CREATE TABLE template (
+			id BIGSERIAL PRIMARY KEY,
+			name VARCHAR NOT NULL,
+			version INTEGER NOT NULL,
+			body VARCHAR,
+			createdby VARCHAR,
+			createdtime TIMESTAMP,
+			deleted BOOLEAN,
+			UNIQUE (name, version)
+		)`,
+
+		`ALTER TABLE campaign ADD COLUMN template VARCHAR, ADD COLUMN templateversion INTEGER`,
+
+		// Sends with a future delivery time, along with their rendered messages, until they are due
+		`CREATE TABLE schedule (
+			id BIGSERIAL PRIMARY KEY,
+			createdtime TIMESTAMP,
+			sendat TIMESTAMP,
+			timezone VARCHAR,
+			status VARCHAR,
+			description VARCHAR,
+			originator VARCHAR,
+			message VARCHAR,
+			template VARCHAR,
+			templateversion INTEGER,
+			recipients INTEGER,
+			messages TEXT,
+			campaignid BIGINT,
+			processedtime TIMESTAMP
+		)`,
+		`CREATE INDEX idx_schedule_status_sendat ON schedule (status, sendat)`,
+
+		`ALTER TABLE schedule ADD COLUMN priority VARCHAR`,
+
+		// Numbers that have opted out, and are only sent emergency messages
+		`CREATE TABLE suppression (
+			id BIGSERIAL PRIMARY KEY,
+			msisdn VARCHAR NOT NULL UNIQUE,
+			reason VARCHAR,
+			source VARCHAR,
+			createdby VARCHAR,
+			createdtime TIMESTAMP
+		)`,
+
+		// Replies from recipients, with 'smsid' referring to the last message sent to the number
+		`CREATE TABLE inbound (
+			id BIGSERIAL PRIMARY KEY,
+			msisdn VARCHAR,
+			recipient VARCHAR,
+			message VARCHAR,
+			receivedtime TIMESTAMP,
+			provider VARCHAR,
+			providerid VARCHAR,
+			smsid BIGINT,
+			keyword VARCHAR
+		)`,
+		`CREATE INDEX idx_inbound_msisdn ON inbound (msisdn)`,
+
+		// Named lists of numbers, with their members in 'groupmember'
+		`CREATE TABLE recipientgroup (
+			id BIGSERIAL PRIMARY KEY,
+			name VARCHAR NOT NULL UNIQUE,
+			description VARCHAR,
+			createdby VARCHAR,
+			createdtime TIMESTAMP
+		)`,
+		`CREATE TABLE groupmember (
+			id BIGSERIAL PRIMARY KEY,
+			groupid BIGINT NOT NULL,
+			msisdn VARCHAR NOT NULL,
+			variables TEXT,
+			addedtime TIMESTAMP,
+			UNIQUE (groupid, msisdn)
+		)`,
+
+		// Queries of the send history
+		`CREATE INDEX idx_sendlog_senttime ON sendlog (senttime, id)`,
+		`CREATE INDEX idx_sms_sendlogid ON sms (sendlogid)`,
+
+		// The provider's description of the status of a message, such as the reason it failed
+		`ALTER TABLE sms ADD COLUMN statusdescription VARCHAR`,
+		`CREATE INDEX idx_sms_providerid ON sms (providerid)`,
+		`CREATE INDEX idx_sendlog_campaignid ON sendlog (campaignid)`,
+
+		// Every status received for a message, with the provider's own code and the source of the status
+		`CREATE TABLE statusevent (
+			id BIGSERIAL PRIMARY KEY,
+			smsid BIGINT NOT NULL,
+			providerid VARCHAR,
+			rawcode VARCHAR,
+			status VARCHAR,
+			description VARCHAR,
+			source VARCHAR,
+			eventtime TIMESTAMP
+		)`,
+		`CREATE INDEX idx_statusevent_smsid ON statusevent (smsid, id)`,
+
+		// A reply that the provider delivers more than once is only stored once
+		`DELETE FROM inbound a USING inbound b
+			WHERE a.provider = b.provider AND a.providerid = b.providerid AND a.providerid <> '' AND a.id > b.id`,
+		`CREATE UNIQUE INDEX idx_inbound_providerid ON inbound (provider, providerid) WHERE providerid <> ''`,
 	}
 
 	for _, src := range text {
@@ -0,0 +1,190 @@
+package messaging
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDispatchInterval  = "5s"
+	defaultProcessingTimeout = "10m"
+)
+
+// Dispatcher drains the outbound queue with a pool of worker goroutines.  Each
+// worker claims one batch of queued messages at a time and sends it through the
+// configured SMS provider.
+type Dispatcher struct {
+	timeout time.Duration // Time after which a claimed batch is assumed to be interrupted
+	quit    chan struct{}
+	wake    chan struct{}
+	claim   sync.Mutex     // Guards claiming batches, and held
+	held    map[int64]bool // Queue entries that are busy being sent by the workers
+	wg      sync.WaitGroup
+}
+
+// Stop signals all of the workers to exit, and waits for any batches that are
+// busy being sent to complete.
+func (d *Dispatcher) Stop() {
+	if d.quit == nil {
+		return
+	}
+	close(d.quit)
+	d.wg.Wait()
+	d.quit = nil
+}
+
+// notify wakes up an idle worker after new messages have been queued.
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *MessagingServer) startDispatcher() error {
+	if !s.Config.Queue.Enabled {
+		return nil
+	}
+
+	iv := s.Config.Queue.PollInterval
+	if iv == "" {
+		iv = defaultDispatchInterval
+	}
+	d, err := time.ParseDuration(iv)
+	if err != nil {
+		s.Log.Errorf("Could not start dispatcher due to invalid poll interval: %v", err)
+		return err
+	}
+
+	s.Dispatcher.timeout = parseDurationOrDefault(s.Config.Queue.ProcessingTimeout, defaultProcessingTimeout)
+	s.Dispatcher.held = map[int64]bool{}
+	if err := s.requeueInterrupted(); err != nil {
+		s.Log.Errorf("Could not reset interrupted queue entries: %v", err)
+		return err
+	}
+
+	workers := s.Config.Queue.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	s.Log.Infof("Starting %v dispatcher workers", workers)
+	s.Dispatcher.quit = make(chan struct{})
+	s.Dispatcher.wake = make(chan struct{}, workers)
+	for i := 0; i < workers; i++ {
+		s.Dispatcher.wg.Add(1)
+		go s.dispatchWorker(d)
+	}
+	return nil
+}
+
+func (s *MessagingServer) dispatchWorker(interval time.Duration) {
+	defer s.Dispatcher.wg.Done()
+	for {
+		sent, err := s.dispatchBatch()
+		if err != nil {
+			s.Log.Errorf("Dispatcher: %v", err)
+		}
+		if sent {
+			// Keep going while there is work available
+			select {
+			case <-s.Dispatcher.quit:
+				return
+			default:
+				continue
+			}
+		}
+		select {
+		case <-s.Dispatcher.quit:
+			return
+		case <-s.Dispatcher.wake:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// dispatchBatch claims and sends the next queued batch.  It returns false if
+// there was nothing to send.
+func (s *MessagingServer) dispatchBatch() (bool, error) {
+	// Claiming is serialized so that a batch is never split between workers
+	s.Dispatcher.claim.Lock()
+	qb, err := s.DB.claimQueuedBatch()
+	if qb != nil {
+		for _, id := range qb.IDs {
+			s.Dispatcher.held[id] = true
+		}
+	}
+	s.Dispatcher.claim.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if qb == nil {
+		return false, s.requeueInterrupted()
+	}
+	defer func() {
+		// If the batch could not be completed, requeueInterrupted completes it from the messages that were sent
+		s.Dispatcher.claim.Lock()
+		for _, id := range qb.IDs {
+			delete(s.Dispatcher.held, id)
+		}
+		s.Dispatcher.claim.Unlock()
+	}()
+
+	p, ok := s.Config.provider(qb.Provider)
+	if !ok {
+		s.Log.Warnf("Provider %v of campaign %v batch %v is no longer configured, sending through %v",
+			qb.Provider, qb.CampaignID, qb.Batch, s.Config.SMSProvider.key())
+		p = s.Config.SMSProvider
+	}
+	br, err := sendSMSBatch(qb.Message, qb.Originator, qb.MSISDNs, qb.CampaignID, qb.Batch, p, s)
+	if err != nil {
+		return true, err
+	}
+	if !br.SendSuccess {
+		s.Log.Warnf("Campaign %v batch %v failed: %v", qb.CampaignID, qb.Batch, br.StatusDescription)
+	}
+	if err := s.DB.completeQueuedBatch(qb, br.SendLogID); err != nil {
+		return true, err
+	}
+	return true, s.DB.finalizeCampaign(qb.CampaignID)
+}
+
+// requeueInterrupted recovers queued messages that were claimed but never
+// completed, because the service was stopped while sending them or the batch
+// could not be completed.  Messages that were sent are completed, and the rest
+// are sent again once they were claimed longer ago than the processing timeout.
+// Batches that the workers of this instance are busy sending are left alone.
+func (s *MessagingServer) requeueInterrupted() error {
+	s.Dispatcher.claim.Lock()
+	var held []int64
+	for id := range s.Dispatcher.held {
+		held = append(held, id)
+	}
+	cIDs, n, err := s.DB.requeueProcessing(time.Now().Add(-s.Dispatcher.timeout), held)
+	s.Dispatcher.claim.Unlock()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		s.Log.Warnf("Requeued %v messages that were interrupted while being sent", n)
+	}
+	for _, cID := range cIDs {
+		s.Log.Warnf("Completed interrupted messages of campaign %v that had already been sent", cID)
+		if err := s.DB.finalizeCampaign(cID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueueSMS creates a campaign and adds every recipient to the outbound queue,
+// to be sent by the dispatcher through the provider it is routed to.
+func (s *MessagingServer) enqueueSMS(msg, eml string, rms []RecipientMessage) (SendResult, error) {
+	cID, err := s.DB.enqueueCampaign(msg, eml, len(rms), s.routeMessages(eml, rms))
+	if err != nil {
+		s.Log.Errorf("Could not queue messages: %v", err)
+		return SendResult{}, errors.New("SendSMS DB error")
+	}
+	s.Dispatcher.notify()
+	return SendResult{CampaignID: cID, Queued: len(rms)}, nil
+}
@@ -0,0 +1,303 @@
+package messaging
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Email transport security options
+const (
+	emailTLSNone     = "none"
+	emailTLSStartTLS = "starttls"
+	emailTLSImplicit = "tls"
+)
+
+// Email is a message to be sent to a list of email addresses.  At least one
+// of Text and HTML must be set.  If both are set, the message contains both
+// parts and the recipient's mail client chooses which one to display.
+type Email struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// cleanEmailAddresses parses the addresses and removes invalid addresses and
+// duplicates.  Only the bare address of entries such as "Name <a@b.com>" is kept.
+func cleanEmailAddresses(as []string) []string {
+	fnd := map[string]bool{}
+	res := []string{}
+	for _, a := range as {
+		ad, err := mail.ParseAddress(strings.TrimSpace(a))
+		if err != nil {
+			continue
+		}
+		k := strings.ToLower(ad.Address)
+		if fnd[k] {
+			continue
+		}
+		fnd[k] = true
+		res = append(res, ad.Address)
+	}
+	return res
+}
+
+// SendEmailMessages sends the email to each of the addresses through the
+// configured SMTP server, in batches of MaxBatchSize addresses.  Like SMS
+// messages, the send is recorded as a campaign with a sendlog entry per batch,
+// but with the type "email".
+func (s *MessagingServer) SendEmailMessages(e Email, eml string, as []string) (SendResult, error) {
+	s.Log.Debugf("User %v sending email '%v' to %v recipients.", eml, e.Subject, len(as))
+
+	var res SendResult
+	c := s.Config.Email
+	if !c.Enabled {
+		return res, errors.New("SendEmail disabled in config, not sending")
+	}
+
+	bs := c.MaxBatchSize
+	if bs <= 0 {
+		bs = len(as)
+	}
+	nb := 0
+	if bs > 0 {
+		nb = (len(as) + bs - 1) / bs
+	}
+	cID, err := s.DB.createCampaign(channelEmail, e.Subject, eml, len(as), nb)
+	if err != nil {
+		return res, errors.New("SendEmail DB error")
+	}
+	res.CampaignID = cID
+
+	for b := 1; len(as) > 0; b++ {
+		n := bs
+		if n > len(as) {
+			n = len(as)
+		}
+		resp, sendErr := c.send(e, as[:n])
+		sendID, err := s.DB.createEmailData(e.Subject, eml, cID, b, resp, sendErr)
+		if err != nil {
+			return res, errors.New("SendEmail DB error")
+		}
+		br := BatchResult{
+			Batch:       b,
+			SendLogID:   sendID,
+			Provider:    c.Host,
+			Recipients:  n,
+			Attempts:    1,
+			SendSuccess: sendErr == nil,
+			Messages:    resp,
+		}
+		if sendErr != nil {
+			br.StatusDescription = sendErr.Error()
+		}
+		res.Batches = append(res.Batches, br)
+		as = as[n:]
+	}
+
+	st, stDesc := "success", ""
+	if err := res.Err(); err != nil {
+		st, stDesc = "failed", err.Error()
+	}
+	if err := s.DB.updateCampaign(cID, res.FailedBatches(), st, stDesc); err != nil {
+		return res, errors.New("SendEmail DB error")
+	}
+	return res, res.Err()
+}
+
+// send delivers the email to each address separately, over a single SMTP
+// session, so that recipients don't see each other's addresses.  If the
+// session fails, the remaining addresses are reported as failed.
+func (c ConfigEmail) send(e Email, as []string) ([]SendSMSResponseMessage, error) {
+	var res []SendSMSResponseMessage
+	failAll := func(from int, err error) ([]SendSMSResponseMessage, error) {
+		for _, a := range as[from:] {
+			res = append(res, SendSMSResponseMessage{To: a, ErrorCode: Failed, ErrorDesc: err.Error()})
+		}
+		return res, err
+	}
+
+	cl, err := c.dial()
+	if err != nil {
+		return failAll(0, err)
+	}
+	defer cl.Close()
+
+	sent := 0
+	for i, a := range as {
+		msgID, body, err := c.compose(e, a)
+		if err == nil {
+			err = c.deliver(cl, a, body)
+		}
+		if err != nil {
+			te, ok := err.(*textproto.Error)
+			if !ok {
+				// The connection failed, so none of the remaining messages can be sent
+				return failAll(i, err)
+			}
+			// The server rejected this recipient, continue with the next one
+			res = append(res, SendSMSResponseMessage{To: a, ErrorCode: strconv.Itoa(te.Code), ErrorDesc: err.Error()})
+			cl.Reset()
+			continue
+		}
+		sent++
+		res = append(res, SendSMSResponseMessage{To: a, MessageID: msgID, Segments: 1})
+	}
+	cl.Quit()
+
+	if sent == 0 && len(res) > 0 {
+		return res, errors.New(res[0].ErrorDesc)
+	}
+	return res, nil
+}
+
+// dial connects and authenticates to the SMTP server
+func (c ConfigEmail) dial() (*smtp.Client, error) {
+	port := c.Port
+	if port == 0 {
+		if c.TLS == emailTLSImplicit {
+			port = 465
+		} else {
+			port = 25
+		}
+	}
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(port))
+	tc := &tls.Config{ServerName: c.Host}
+
+	var cl *smtp.Client
+	if c.TLS == emailTLSImplicit {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tc)
+		if err != nil {
+			return nil, err
+		}
+		if cl, err = smtp.NewClient(conn, c.Host); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else {
+		conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if cl, err = smtp.NewClient(conn, c.Host); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if c.TLS != emailTLSNone {
+			if ok, _ := cl.Extension("STARTTLS"); !ok {
+				cl.Close()
+				return nil, errors.New("SMTP server does not support STARTTLS")
+			}
+			if err := cl.StartTLS(tc); err != nil {
+				cl.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if c.Username != "" {
+		if err := cl.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			cl.Close()
+			return nil, err
+		}
+	}
+	return cl, nil
+}
+
+func (c ConfigEmail) deliver(cl *smtp.Client, to string, body []byte) error {
+	from, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return err
+	}
+	if err := cl.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := cl.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := cl.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// compose builds the MIME message for a single recipient, and returns its Message-ID
+func (c ConfigEmail) compose(e Email, to string) (string, []byte, error) {
+	from, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return "", nil, fmt.Errorf("Invalid from address: %v", err)
+	}
+	var rnd [16]byte
+	rand.Read(rnd[:])
+	msgID := fmt.Sprintf("%x@%v", rnd, c.Host)
+
+	var b bytes.Buffer
+	hdr := func(k, v string) {
+		fmt.Fprintf(&b, "%v: %v\r\n", k, v)
+	}
+	hdr("From", from.String())
+	hdr("To", to)
+	hdr("Subject", mime.QEncoding.Encode("utf-8", e.Subject))
+	hdr("Date", time.Now().Format(time.RFC1123Z))
+	hdr("Message-ID", "<"+msgID+">")
+	hdr("MIME-Version", "1.0")
+
+	if e.Text == "" || e.HTML == "" {
+		ct, body := "text/plain", e.Text
+		if e.HTML != "" {
+			ct, body = "text/html", e.HTML
+		}
+		hdr("Content-Type", ct+"; charset=utf-8")
+		hdr("Content-Transfer-Encoding", "quoted-printable")
+		b.WriteString("\r\n")
+		if err := writeQuotedPrintable(&b, body); err != nil {
+			return "", nil, err
+		}
+		return msgID, b.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&b)
+	hdr("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	b.WriteString("\r\n")
+	for _, p := range []struct{ ct, body string }{{"text/plain", e.Text}, {"text/html", e.HTML}} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.ct + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		if err := writeQuotedPrintable(pw, p.body); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", nil, err
+	}
+	return msgID, b.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
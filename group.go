@@ -0,0 +1,90 @@
+package messaging
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// RecipientGroup is a named list of numbers that messages can be sent to,
+// such as "Ward 12 stand owners".  Members may carry variables for templates.
+type RecipientGroup struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Members     int       `json:"members"`
+	CreatedBy   string    `json:"createdBy"`
+	CreatedTime time.Time `json:"createdTime"`
+}
+
+// ImportResult reports the outcome of adding members to a group
+type ImportResult struct {
+	Imported   int      `json:"imported"`   // Members that were added or updated
+	Invalid    []string `json:"invalid"`    // Numbers that could not be cleaned
+	Duplicates int      `json:"duplicates"` // Numbers that occurred more than once in the request
+}
+
+// CreateGroup creates an empty group
+func (s *MessagingServer) CreateGroup(name, description, eml string) (RecipientGroup, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return RecipientGroup{}, errors.New("Group name is empty")
+	}
+	g := RecipientGroup{Name: name, Description: description, CreatedBy: eml, CreatedTime: time.Now().UTC()}
+	var err error
+	g.ID, err = s.DB.createGroup(g)
+	return g, err
+}
+
+// ImportGroupMembers cleans the numbers of the members and adds them to the
+// group.  Members that are already in the group have their variables replaced.
+func (s *MessagingServer) ImportGroupMembers(groupID string, rs []Recipient) (ImportResult, error) {
+	res := ImportResult{Invalid: []string{}}
+	if _, err := s.DB.getGroup(groupID); err != nil {
+		return res, err
+	}
+	var clean []Recipient
+	fnd := map[string]bool{}
+	for _, r := range rs {
+		ns := cleanMSISDNs([]string{r.MSISDN}, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)
+		if len(ns) == 0 {
+			res.Invalid = append(res.Invalid, r.MSISDN)
+			continue
+		}
+		if fnd[ns[0]] {
+			res.Duplicates++
+			continue
+		}
+		fnd[ns[0]] = true
+		clean = append(clean, Recipient{MSISDN: ns[0], Variables: r.Variables})
+	}
+	if err := s.DB.addGroupMembers(groupID, clean); err != nil {
+		return res, err
+	}
+	res.Imported = len(clean)
+	return res, nil
+}
+
+// GroupRecipients returns the members of the groups, in the order of the
+// groups.  A number that is in more than one group is only returned once, with
+// the variables of its first group.
+func (s *MessagingServer) GroupRecipients(groupIDs []string) ([]Recipient, error) {
+	for _, id := range groupIDs {
+		if _, err := s.DB.getGroup(id); err != nil {
+			return nil, errors.New("Group " + id + " does not exist")
+		}
+	}
+	ms, err := s.DB.groupMembers(groupIDs)
+	if err != nil {
+		return nil, err
+	}
+	var rs []Recipient
+	fnd := map[string]bool{}
+	for _, m := range ms {
+		if !fnd[m.MSISDN] {
+			fnd[m.MSISDN] = true
+			rs = append(rs, m)
+		}
+	}
+	return rs, nil
+}
@@ -0,0 +1,189 @@
+package messaging
+
+import (
+	"unicode/utf16"
+)
+
+// Message encodings, as recorded on every SMS
+const (
+	EncodingGSM7 = "gsm7" // GSM 03.38 default alphabet, 7 bits per character
+	EncodingUCS2 = "ucs2" // UCS-2 (UTF-16), 16 bits per character
+)
+
+// Characters per segment of single and concatenated messages.  Parts of a
+// concatenated message are shorter because they start with a user data header.
+const (
+	gsm7SingleLength = 160
+	gsm7PartLength   = 153
+	ucs2SingleLength = 70
+	ucs2PartLength   = 67
+)
+
+const gsm7Escape = 0x1B
+
+// gsm7Basic is the GSM 03.38 default alphabet, indexed by septet.  The escape
+// to the extension table at 0x1B is not a character.
+var gsm7Basic = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// gsm7Extension holds the characters of the extension table, which are sent as
+// the escape septet followed by the septet given here.
+var gsm7Extension = map[rune]byte{
+	'\f': 0x0A,
+	'^':  0x14,
+	'{':  0x28,
+	'}':  0x29,
+	'\\': 0x2F,
+	'[':  0x3C,
+	'~':  0x3D,
+	']':  0x3E,
+	'|':  0x40,
+	'€':  0x65,
+}
+
+var gsm7Septets = map[rune]byte{}
+
+func init() {
+	for i, r := range gsm7Basic {
+		if i != gsm7Escape {
+			gsm7Septets[r] = byte(i)
+		}
+	}
+}
+
+// detectEncoding returns EncodingGSM7 if every character of the text is in the
+// GSM 03.38 default alphabet or its extension table, and EncodingUCS2 otherwise.
+func detectEncoding(text string) string {
+	for _, r := range text {
+		if _, ok := gsm7Septets[r]; ok {
+			continue
+		}
+		if _, ok := gsm7Extension[r]; ok {
+			continue
+		}
+		return EncodingUCS2
+	}
+	return EncodingGSM7
+}
+
+// encodeGSM7 encodes the text as unpacked GSM 03.38 septets, one per byte.
+// Characters from the extension table take two septets.  Characters outside the
+// alphabet are replaced with '?', so the text should be checked with
+// detectEncoding first.
+func encodeGSM7(text string) []byte {
+	b := make([]byte, 0, len(text))
+	for _, r := range text {
+		if c, ok := gsm7Septets[r]; ok {
+			b = append(b, c)
+		} else if c, ok := gsm7Extension[r]; ok {
+			b = append(b, gsm7Escape, c)
+		} else {
+			b = append(b, '?')
+		}
+	}
+	return b
+}
+
+// encodeUCS2 encodes the text as big-endian UTF-16.  Characters outside the
+// basic multilingual plane take two code units, as a surrogate pair.
+func encodeUCS2(text string) []byte {
+	us := utf16.Encode([]rune(text))
+	b := make([]byte, 0, 2*len(us))
+	for _, u := range us {
+		b = append(b, byte(u>>8), byte(u))
+	}
+	return b
+}
+
+// encodeMessage encodes the text in the given encoding, and returns a function
+// that reports whether the encoded text may be split into separate segments at
+// a byte offset, so that escape sequences and surrogate pairs are kept whole.
+func encodeMessage(text, encoding string) ([]byte, func(i int) bool) {
+	if encoding == EncodingUCS2 {
+		b := encodeUCS2(text)
+		return b, func(i int) bool {
+			// Don't split between the high and low surrogate of a pair
+			return i%2 == 0 && !(b[i-2] >= 0xD8 && b[i-2] <= 0xDB)
+		}
+	}
+	b := encodeGSM7(text)
+	return b, func(i int) bool {
+		return b[i-1] != gsm7Escape
+	}
+}
+
+// MessageInfo describes how a message will be sent: its encoding, its length
+// and the number of segments.  Lengths are in septets for GSM messages, where
+// characters from the extension table take two septets, and in 16-bit code
+// units for UCS-2 messages, where characters outside the basic multilingual
+// plane take two units.
+type MessageInfo struct {
+	Encoding          string  `json:"encoding"`
+	Characters        int     `json:"characters"`
+	Septets           int     `json:"septets,omitempty"`
+	CodeUnits         int     `json:"codeUnits,omitempty"`
+	Segments          int     `json:"segments"`
+	SegmentLength     int     `json:"segmentLength"`     // Capacity of each segment, which is less for concatenated parts
+	Remaining         int     `json:"remaining"`         // Septets or code units left before another segment is needed
+	MaxSegments       int     `json:"maxSegments"`       // The limit set in the config
+	Valid             bool    `json:"valid"`             // True if the message is not empty and within MaxSegments
+	Recipients        int     `json:"recipients"`        // Recipients that the cost is estimated for
+	EstimatedCost     float64 `json:"estimatedCost"`     // Segments times recipients times each provider's cost per segment
+	CostPerProvider   []Cost  `json:"costPerProvider"`   // Breakdown of the estimate by the provider the recipients are routed to
+	ValidationMessage string  `json:"validationMessage"` // Reason that the message is not valid
+}
+
+// Cost is the estimated cost of sending a message to the recipients routed to a provider
+type Cost struct {
+	Provider   string  `json:"provider"`
+	Recipients int     `json:"recipients"`
+	Segments   int     `json:"segments"`
+	Cost       float64 `json:"cost"`
+}
+
+// calculateMessage determines the encoding, length and segments of a message.
+// Segments are counted by splitting the encoded text in the same way as the
+// SMPP provider does, so escape sequences and surrogate pairs are never split.
+func calculateMessage(text string) MessageInfo {
+	info := MessageInfo{Encoding: detectEncoding(text), Characters: len([]rune(text))}
+	b, canSplit := encodeMessage(text, info.Encoding)
+	single, part, unit := gsm7SingleLength, gsm7PartLength, 1
+	if info.Encoding == EncodingUCS2 {
+		single, part, unit = ucs2SingleLength, ucs2PartLength, 2
+		info.CodeUnits = len(b) / unit
+	} else {
+		info.Septets = len(b)
+	}
+
+	segs, last := countSegments(len(b), single*unit, part*unit, canSplit)
+	info.Segments = segs
+	info.SegmentLength = single
+	if segs > 1 {
+		info.SegmentLength = part
+	}
+	info.Remaining = info.SegmentLength - last/unit
+	return info
+}
+
+// countSegments counts the segments of an encoded message of n bytes, splitting
+// only where canSplit allows, in the same way as smpp.SplitAt.  It also returns
+// the length of the last segment.
+func countSegments(n, single, part int, canSplit func(i int) bool) (int, int) {
+	if n <= single {
+		return 1, n
+	}
+	segs, last := 0, 0
+	for start := 0; start < n; segs++ {
+		end := start + part
+		if end >= n {
+			end = n
+		} else {
+			for end > start+1 && !canSplit(end) {
+				end--
+			}
+		}
+		last = end - start
+		start = end
+	}
+	return segs, last
+}
@@ -0,0 +1,68 @@
+package messaging
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCalculateMessage(t *testing.T) {
+	a := func(n int) string { return strings.Repeat("a", n) }
+	zh := func(n int) string { return strings.Repeat("ж", n) }
+	for _, c := range []struct {
+		name      string
+		text      string
+		encoding  string
+		length    int // Septets or code units
+		segments  int
+		remaining int
+	}{
+		{"empty", "", EncodingGSM7, 0, 1, 160},
+		{"single", a(160), EncodingGSM7, 160, 1, 0},
+		{"two parts", a(161), EncodingGSM7, 161, 2, 145},
+		{"two full parts", a(306), EncodingGSM7, 306, 2, 0},
+		{"three parts", a(307), EncodingGSM7, 307, 3, 152},
+		{"escape fits single", a(158) + "€", EncodingGSM7, 160, 1, 0},
+		{"escape overflows single", a(159) + "€", EncodingGSM7, 161, 2, 145},
+		// The escape sequence would straddle the end of the first part, so it moves to the second
+		{"escape not split", a(152) + "€" + a(7), EncodingGSM7, 161, 2, 144},
+		{"ucs2 single", zh(70), EncodingUCS2, 70, 1, 0},
+		{"ucs2 two parts", zh(71), EncodingUCS2, 71, 2, 63},
+		{"ucs2 two full parts", zh(134), EncodingUCS2, 134, 2, 0},
+		{"surrogate pair fits single", zh(68) + "😀", EncodingUCS2, 70, 1, 0},
+		// The surrogate pair would straddle the end of the first part, so it moves to the second
+		{"surrogate pair not split", zh(66) + "😀" + zh(3), EncodingUCS2, 71, 2, 62},
+	} {
+		info := calculateMessage(c.text)
+		length := info.Septets
+		if c.encoding == EncodingUCS2 {
+			length = info.CodeUnits
+		}
+		if info.Encoding != c.encoding || length != c.length || info.Segments != c.segments || info.Remaining != c.remaining {
+			t.Errorf("%v: calculateMessage() = %v, %v units, %v segments, %v remaining, want %v, %v, %v, %v",
+				c.name, info.Encoding, length, info.Segments, info.Remaining, c.encoding, c.length, c.segments, c.remaining)
+		}
+	}
+}
+
+func TestCountSegments(t *testing.T) {
+	always := func(i int) bool { return true }
+	for _, c := range []struct {
+		n, single, part int
+		canSplit        func(i int) bool
+		segments, last  int
+	}{
+		{0, 160, 153, always, 1, 0},
+		{160, 160, 153, always, 1, 160},
+		{161, 160, 153, always, 2, 8},
+		{459, 160, 153, always, 3, 153},
+		{140, 140, 134, always, 1, 140},
+		{141, 140, 134, always, 2, 7},
+		// Splits move back to the previous allowed position
+		{161, 160, 153, func(i int) bool { return i%10 == 0 }, 2, 11},
+	} {
+		segs, last := countSegments(c.n, c.single, c.part, c.canSplit)
+		if segs != c.segments || last != c.last {
+			t.Errorf("countSegments(%v, %v, %v) = %v, %v, want %v, %v", c.n, c.single, c.part, segs, last, c.segments, c.last)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package messaging
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits on the number of sends returned by a history query
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// cursorTimeFormat is the format of sendlog times in a cursor, which is also
+// understood by Postgres
+const cursorTimeFormat = "2006-01-02 15:04:05.999999"
+
+// historySorts are the sendlog columns that the history can be sorted by
+var historySorts = map[string]string{
+	"sentTime":  "senttime",
+	"quantity":  "quantity",
+	"delivered": "delivered",
+	"failed":    "failed",
+}
+
+// SendLogEntry is a batch of messages that was sent to the provider
+type SendLogEntry struct {
+	ID          string    `json:"id"`
+	RefNumber   string    `json:"refNumber"` // The campaign that the batch belongs to
+	Batch       int       `json:"batch"`
+	SentTime    time.Time `json:"sentTime"`
+	Originator  string    `json:"originator"`
+	Type        string    `json:"type"` // sms or email
+	Provider    string    `json:"provider"`
+	Quantity    int       `json:"quantity"`
+	Delivered   int       `json:"delivered"`
+	Failed      int       `json:"failed"`
+	Sent        int       `json:"sent"` // Messages without a final delivery status
+	Message     string    `json:"message"`
+	Status      string    `json:"status"` // success or failed
+	Description string    `json:"description"`
+}
+
+// SendLogMessage is a single message of a batch, with its current status
+type SendLogMessage struct {
+	ID          string     `json:"id"`
+	To          string     `json:"to"`
+	SentTime    time.Time  `json:"sentTime"`
+	Segments    int        `json:"segments,omitempty"`
+	Status      string     `json:"status"`
+	StatusTime  *time.Time `json:"statusTime,omitempty"`
+	ProviderID  string     `json:"providerId"`
+	Provider    string     `json:"provider,omitempty"`
+	Encoding    string     `json:"encoding,omitempty"`
+	Description string     `json:"description,omitempty"`
+}
+
+// SendLogDetail is a batch along with every one of its messages
+type SendLogDetail struct {
+	SendLogEntry
+	Messages []SendLogMessage `json:"messages"`
+}
+
+// HistoryQuery selects a page of the send history.  Empty fields are not filtered on.
+type HistoryQuery struct {
+	Originator string
+	From       time.Time // Inclusive
+	To         time.Time // Exclusive
+	Status     string
+	Type       string
+	Message    string // Text that the message contains, ignoring case
+	Sort       string // Key of historySorts
+	Ascending  bool
+	Limit      int
+	After      *historyCursor // Position after which the page starts
+}
+
+// HistoryPage is a page of the send history.  NextCursor is empty on the last page.
+type HistoryPage struct {
+	Sends      []SendLogEntry `json:"sends"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// historyCursor is the position of a sendlog entry in the sort order
+type historyCursor struct {
+	Value string // Value of the sort column
+	ID    int64
+}
+
+func (c historyCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Value + "|" + strconv.FormatInt(c.ID, 10)))
+}
+
+func parseHistoryCursor(s string) (*historyCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	i := strings.LastIndex(string(b), "|")
+	if i < 0 {
+		return nil, errors.New("Invalid cursor")
+	}
+	id, err := strconv.ParseInt(string(b[i+1:]), 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	return &historyCursor{Value: string(b[:i]), ID: id}, nil
+}
+
+// cursorFor returns the cursor of an entry in the sort order of the query
+func (q HistoryQuery) cursorFor(e SendLogEntry) historyCursor {
+	id, _ := strconv.ParseInt(e.ID, 10, 64)
+	c := historyCursor{ID: id}
+	switch q.Sort {
+	case "quantity":
+		c.Value = strconv.Itoa(e.Quantity)
+	case "delivered":
+		c.Value = strconv.Itoa(e.Delivered)
+	case "failed":
+		c.Value = strconv.Itoa(e.Failed)
+	default:
+		c.Value = e.SentTime.UTC().Format(cursorTimeFormat)
+	}
+	return c
+}
+
+// parseHistoryQuery reads a history query from URL query parameters.  'from'
+// and 'to' are RFC3339 times or dates, with 'to' including the whole day if it
+// is a date.  'sort' is a sortable field, preceded by '-' for descending order,
+// and defaults to the most recent sends first.
+func parseHistoryQuery(v url.Values) (HistoryQuery, error) {
+	q := HistoryQuery{
+		Originator: v.Get("originator"),
+		Status:     v.Get("status"),
+		Type:       v.Get("type"),
+		Message:    v.Get("message"),
+		Sort:       "sentTime",
+		Limit:      defaultHistoryLimit,
+	}
+	var err error
+	if s := v.Get("from"); s != "" {
+		if q.From, _, err = parseHistoryTime(s); err != nil {
+			return q, errors.New("Invalid from time")
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		var date bool
+		if q.To, date, err = parseHistoryTime(s); err != nil {
+			return q, errors.New("Invalid to time")
+		}
+		if date {
+			q.To = q.To.AddDate(0, 0, 1)
+		}
+	}
+	if s := v.Get("sort"); s != "" {
+		q.Ascending = !strings.HasPrefix(s, "-")
+		q.Sort = strings.TrimPrefix(s, "-")
+		if historySorts[q.Sort] == "" {
+			return q, errors.New("Sort must be one of sentTime, quantity, delivered or failed")
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return q, errors.New("Invalid limit")
+		}
+		if q.Limit > maxHistoryLimit {
+			q.Limit = maxHistoryLimit
+		}
+	}
+	if s := v.Get("cursor"); s != "" {
+		if q.After, err = parseHistoryCursor(s); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// parseHistoryTime parses an RFC3339 time, or a date in UTC, and reports whether it was a date
+func parseHistoryTime(s string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), false, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	return t, true, err
+}
+
+// GetHistory returns a page of the send history
+func (s *MessagingServer) GetHistory(q HistoryQuery) (HistoryPage, error) {
+	// One more entry than the limit is retrieved, to find out if there is a next page
+	es, err := s.DB.listSendLogs(q, q.Limit+1)
+	if err != nil {
+		return HistoryPage{}, err
+	}
+	p := HistoryPage{Sends: es}
+	if len(es) > q.Limit {
+		p.Sends = es[:q.Limit]
+		p.NextCursor = q.cursorFor(p.Sends[q.Limit-1]).String()
+	}
+	return p, nil
+}
@@ -0,0 +1,89 @@
+package messaging
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseHistoryQuery(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	def := HistoryQuery{Sort: "sentTime", Limit: defaultHistoryLimit}
+	with := func(f func(q *HistoryQuery)) HistoryQuery {
+		q := def
+		f(&q)
+		return q
+	}
+	for _, c := range []struct {
+		query   string
+		want    HistoryQuery
+		wantErr bool
+	}{
+		{"", def, false},
+		{"originator=a@imqs.co.za&status=failed&type=sms&message=water", with(func(q *HistoryQuery) {
+			q.Originator, q.Status, q.Type, q.Message = "a@imqs.co.za", "failed", "sms", "water"
+		}), false},
+		// A date includes the whole day in 'to'
+		{"from=2024-01-02&to=2024-01-05", with(func(q *HistoryQuery) { q.From, q.To = day(2), day(6) }), false},
+		{"from=2024-01-02T02:00:00%2B02:00&to=2024-01-05T10:00:00Z", with(func(q *HistoryQuery) {
+			q.From, q.To = day(2), day(5).Add(10*time.Hour)
+		}), false},
+		{"sort=quantity", with(func(q *HistoryQuery) { q.Sort, q.Ascending = "quantity", true }), false},
+		{"sort=-failed", with(func(q *HistoryQuery) { q.Sort = "failed" }), false},
+		{"limit=10", with(func(q *HistoryQuery) { q.Limit = 10 }), false},
+		{"limit=100000", with(func(q *HistoryQuery) { q.Limit = maxHistoryLimit }), false},
+		{"cursor=" + historyCursor{"5", 12}.String(), with(func(q *HistoryQuery) { q.After = &historyCursor{"5", 12} }), false},
+		{"from=yesterday", HistoryQuery{}, true},
+		{"to=2024-13-01", HistoryQuery{}, true},
+		{"sort=message", HistoryQuery{}, true},
+		{"limit=0", HistoryQuery{}, true},
+		{"limit=ten", HistoryQuery{}, true},
+		{"cursor=%25%25", HistoryQuery{}, true},
+	} {
+		v, _ := url.ParseQuery(c.query)
+		q, err := parseHistoryQuery(v)
+		if (err != nil) != c.wantErr {
+			t.Errorf("parseHistoryQuery(%v) returned error %v", c.query, err)
+			continue
+		}
+		if !c.wantErr && !reflect.DeepEqual(q, c.want) {
+			t.Errorf("parseHistoryQuery(%v) = %+v, want %+v", c.query, q, c.want)
+		}
+	}
+}
+
+func TestHistoryCursor(t *testing.T) {
+	sent := time.Date(2024, 1, 5, 10, 30, 15, 123456000, time.FixedZone("SAST", 2*60*60))
+	e := SendLogEntry{ID: "42", SentTime: sent, Quantity: 7, Delivered: 5, Failed: 2}
+	for _, c := range []struct {
+		sort string
+		want historyCursor
+	}{
+		{"sentTime", historyCursor{"2024-01-05 08:30:15.123456", 42}},
+		{"", historyCursor{"2024-01-05 08:30:15.123456", 42}},
+		{"quantity", historyCursor{"7", 42}},
+		{"delivered", historyCursor{"5", 42}},
+		{"failed", historyCursor{"2", 42}},
+	} {
+		cur := HistoryQuery{Sort: c.sort}.cursorFor(e)
+		if cur != c.want {
+			t.Errorf("cursorFor(%v) = %+v, want %+v", c.sort, cur, c.want)
+		}
+		got, err := parseHistoryCursor(cur.String())
+		if err != nil || *got != c.want {
+			t.Errorf("Cursor %+v did not round trip: %+v, %v", c.want, got, err)
+		}
+	}
+
+	// The value may itself contain the separator
+	want := historyCursor{"a|b", 1}
+	if got, err := parseHistoryCursor(want.String()); err != nil || *got != want {
+		t.Errorf("Cursor %+v did not round trip: %+v, %v", want, got, err)
+	}
+	for _, s := range []string{"", "!!", "bm9zZXBhcmF0b3I", "dmFsdWV8aWQ"} { // "noseparator" and "value|id"
+		if _, err := parseHistoryCursor(s); err == nil {
+			t.Errorf("Expected cursor %q to be invalid", s)
+		}
+	}
+}
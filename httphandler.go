@@ -1,29 +1,88 @@
 package messaging
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/IMQS/messaging/clickatell"
 	"github.com/julienschmidt/httprouter"
 )
 
 type sendSMSResponse struct {
-	RefNumber         string `json:"refNumber"`
-	ValidNumbers      int    `json:"validNumbers"`
-	InvalidNumbers    int    `json:"invalidNumbers"`
-	SendSuccess       bool   `json:"sendSuccess"`
-	StatusDescription string `json:"statusDescription"`
-	MessagesSent      int    `json:"messagesSent"`
+	RefNumber         string          `json:"refNumber"`
+	ValidNumbers      int             `json:"validNumbers"`
+	InvalidNumbers    int             `json:"invalidNumbers"`
+	SuppressedNumbers int             `json:"suppressedNumbers"` // Valid numbers that opted out, and were not sent the message
+	SendSuccess       bool            `json:"sendSuccess"`
+	StatusDescription string          `json:"statusDescription"`
+	MessagesSent      int             `json:"messagesSent"`
+	MessagesQueued    int             `json:"messagesQueued"`
+	Batches           []BatchResult   `json:"batches"`
+	Scheduled         *ScheduledSend  `json:"scheduled,omitempty"`
+	MessagesDeferred  int             `json:"messagesDeferred"`
+	Deferred          []ScheduledSend `json:"deferred,omitempty"` // Messages held back until the recipients' send window opens
+	Numbers           []MSISDNInputs  `json:"numbers,omitempty"`  // The cleaned numbers, with their positions in the request
 }
 
+// SMSRequest is the body of a /sendsms request.  A personalised message is
+// sent when a template is named or recipients or groups are given: the
+// template, or else the message, is rendered with the variables of each
+// recipient.
 type SMSRequest struct {
-	MSISDNS []string `json:"msisdns"`
-	Message string   `json:"message"`
+	MSISDNS         []string    `json:"msisdns"`
+	Groups          []string    `json:"groups"` // IDs of recipient groups whose members are added as recipients
+	Message         string      `json:"message"`
+	Template        string      `json:"template"`
+	TemplateVersion int         `json:"templateVersion"` // Defaults to the latest version
+	Recipients      []Recipient `json:"recipients"`
+	SendAt          string      `json:"sendAt"`   // Optional delivery time, e.g. "2016-10-20T08:00:00"
+	TimeZone        string      `json:"timeZone"` // Time zone of sendAt if it has no UTC offset, e.g. "Africa/Johannesburg"
+	Priority        string      `json:"priority"` // normal (default), urgent or emergency. Only normal messages are held back outside send windows
+}
+
+// RescheduleRequest is the body of a request to change the delivery time of a scheduled send
+type RescheduleRequest struct {
+	SendAt   string `json:"sendAt"`
+	TimeZone string `json:"timeZone"`
+}
+
+// TemplateRequest is the body of a request to create or update a template
+type TemplateRequest struct {
+	Name string `json:"name"`
+	Body string `json:"body"`
+}
+
+// MessageInfoRequest is the body of a /messageinfo request.  The cost is
+// estimated for the numbers if they are given, or else for Recipients.
+type MessageInfoRequest struct {
+	Message    string   `json:"message"`
+	MSISDNS    []string `json:"msisdns"`
+	Recipients int      `json:"recipients"`
+}
+
+// EmailRequest is the body of a /sendemail request.  At least one of Text and
+// HTML must be given.
+type EmailRequest struct {
+	Addresses []string `json:"addresses"`
+	Subject   string   `json:"subject"`
+	Text      string   `json:"text"`
+	HTML      string   `json:"html"`
 }
 
-const smsCharLength = 160
+type sendEmailResponse struct {
+	RefNumber         string        `json:"refNumber"`
+	ValidAddresses    int           `json:"validAddresses"`
+	InvalidAddresses  int           `json:"invalidAddresses"`
+	SendSuccess       bool          `json:"sendSuccess"`
+	StatusDescription string        `json:"statusDescription"`
+	MessagesSent      int           `json:"messagesSent"`
+	Batches           []BatchResult `json:"batches"`
+}
 
 // StartServer is called to read the config file and initiate
 // the HTTP server.
@@ -31,9 +90,42 @@ func (s *MessagingServer) StartServer() error {
 	address := fmt.Sprintf(":%v", s.Config.HTTPPort)
 	router := httprouter.New()
 	router.GET("/messagestatus/:msisdn", s.handleMessageStatus)
+	router.GET("/campaign/:refNumber", s.handleCampaignStatus)
+	router.GET("/status/provider/:id", s.handleProviderMessageStatus)
+	router.GET("/status/msisdn/:msisdn", s.handleNumberMessageStatus)
+	router.GET("/messages/:id/timeline", s.handleMessageTimeline)
+	router.POST("/messages/:id/status", s.handleSetMessageStatus)
+	router.GET("/providers/breakers", s.handleBreakers)
 	router.GET("/ping", s.handlePing)
 	router.POST("/sendsms", s.handleSendSMS)
+	router.POST("/sendemail", s.handleSendEmail)
 	router.POST("/normalize", s.handleNormalize)
+	router.POST("/messageinfo", s.handleMessageInfo)
+	router.GET("/templates", s.handleListTemplates)
+	router.POST("/templates", s.handleCreateTemplate)
+	router.GET("/templates/:name", s.handleGetTemplate)
+	router.PUT("/templates/:name", s.handleUpdateTemplate)
+	router.DELETE("/templates/:name", s.handleDeleteTemplate)
+	router.GET("/templates/:name/versions", s.handleTemplateVersions)
+	router.GET("/schedules", s.handleListSchedules)
+	router.GET("/schedules/:id", s.handleGetSchedule)
+	router.PUT("/schedules/:id", s.handleReschedule)
+	router.DELETE("/schedules/:id", s.handleCancelSchedule)
+	router.GET("/suppressions", s.handleListSuppressions)
+	router.POST("/suppressions", s.handleAddSuppressions)
+	router.DELETE("/suppressions/:msisdn", s.handleRemoveSuppression)
+	router.GET("/groups", s.handleListGroups)
+	router.POST("/groups", s.handleCreateGroup)
+	router.GET("/groups/:id", s.handleGetGroup)
+	router.DELETE("/groups/:id", s.handleDeleteGroup)
+	router.POST("/groups/:id/members", s.handleImportGroupMembers)
+	router.DELETE("/groups/:id/members/:msisdn", s.handleRemoveGroupMember)
+	router.GET("/sends", s.handleListSends)
+	router.GET("/sends/:id", s.handleGetSend)
+	router.POST("/upload/recipients", s.handleUploadRecipients)
+	router.POST("/callback/clickatell", s.handleClickatellCallback)
+	router.POST("/inbound/clickatell", s.handleClickatellInbound)
+	router.GET("/inbound", s.handleListInbound)
 
 	s.Log.Infof("Messaging is listening on %v", address)
 	err := http.ListenAndServe(address, router)
@@ -45,8 +137,8 @@ func (s *MessagingServer) StartServer() error {
 }
 
 // HandleSendSMS should called with form-data specifying a message, and a comma-separated list of msisdns.
-// It can be expanded to accept a JSON object containing fields such as name, surname, age, etc.  These
-// can then be replaced in the message before sending to allow for personalized messages.
+// Alternatively a template, or a message with placeholders, can be sent to a list of recipients that each
+// carry variables such as name and surname, which are replaced in the message before sending.
 func (s *MessagingServer) handleSendSMS(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	userAuth, identity := userHasPermission(s, r)
 	if userAuth != true {
@@ -62,41 +154,159 @@ func (s *MessagingServer) handleSendSMS(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	var sendAt time.Time
+	var timeZone string
+	if postData.SendAt != "" {
+		if sendAt, timeZone, err = parseSendAt(postData.SendAt, postData.TimeZone); err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+	}
+	if !validPriority(postData.Priority) {
+		http.Error(w, "Priority must be normal, urgent or emergency", http.StatusNotAcceptable)
+		return
+	}
+
+	if postData.Template != "" || len(postData.Recipients) > 0 || len(postData.Groups) > 0 {
+		s.sendTemplate(w, postData, identity, sendAt, timeZone)
+		return
+	}
+
 	if len(postData.Message) == 0 || len(postData.MSISDNS) == 0 {
 		http.Error(w, "Invalid message or msisdn data", http.StatusNotAcceptable)
 		return
 	}
 
-	// Strip out any non-ascii characters from the message that could result in
-	// multiple messages being sent.
-	cleanMsg := allowOnlyASCII(postData.Message)
-
-	// SMS with 7 bit character encoding messages are limited to a lenght of 160 characters.
-	// Check if message fits into one message (segements * sms length)
-	if len(cleanMsg) > s.Config.SMSProvider.MaxMessageSegments*smsCharLength {
-		lErr := fmt.Sprintf("Message exceeds max allowed length (%v characters)", s.Config.SMSProvider.MaxMessageSegments*smsCharLength)
-		http.Error(w, lErr, http.StatusNotAcceptable)
+	// Messages that only use the GSM 7-bit alphabet are sent as such, anything else
+	// is sent as UCS-2, which has less than half the characters per segment.
+	cleanMsg := postData.Message
+	if info := s.GetMessageInfo(cleanMsg, identity, nil, 0); !info.Valid {
+		http.Error(w, info.ValidationMessage, http.StatusNotAcceptable)
 		return
 	}
 
 	s.Log.Debugf("Request received from %v: send '%v' to %v recipients.", identity, cleanMsg, len(postData.MSISDNS))
 
-	cns := cleanMSISDNs(postData.MSISDNS, s.Config.SMSProvider.Countries)
-	sendID, err := s.SendSMSMessages(cleanMsg, identity, cns)
+	cns := mapMSISDNs(postData.MSISDNS, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)
+	rms := make([]RecipientMessage, len(cns))
+	for i, n := range cns {
+		rms[i] = RecipientMessage{MSISDN: n.MSISDN, Text: cleanMsg}
+	}
+	s.sendOrSchedule(w, Template{Body: cleanMsg}, identity, rms, cns, len(postData.MSISDNS)-len(cns), sendAt, timeZone, postData.Priority)
+}
+
+// sendTemplate sends a personalised message for /sendsms.  Numbers listed in
+// msisdns are added as recipients without variables, followed by the members of
+// the groups.  A number is only sent one message, even if it is listed more
+// than once.  If the message can't be rendered for some of the recipients,
+// nothing is sent and the recipients are listed in the response.  The positions
+// of the numbers in the response count the recipients in this order.
+func (s *MessagingServer) sendTemplate(w http.ResponseWriter, postData SMSRequest, identity string, sendAt time.Time, timeZone string) {
+	t := Template{Body: postData.Message}
+	if postData.Template != "" {
+		var err error
+		if t, err = s.GetTemplate(postData.Template, postData.TemplateVersion); err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+	}
+	rs := postData.Recipients
+	for _, n := range postData.MSISDNS {
+		rs = append(rs, Recipient{MSISDN: n})
+	}
+	if len(postData.Groups) > 0 {
+		grs, err := s.GroupRecipients(postData.Groups)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+		rs = append(rs, grs...)
+	}
+	if t.Body == "" || len(rs) == 0 {
+		http.Error(w, "Invalid message or recipient data", http.StatusNotAcceptable)
+		return
+	}
+
+	rms, numbers, removed, err := s.RenderMessages(t.Body, identity, rs)
+	if err != nil {
+		rErr, ok := err.(*RenderError)
+		if !ok {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		js, _ := json.Marshal(rErr)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write(js)
+		return
+	}
+	s.sendOrSchedule(w, t, identity, rms, numbers, removed, sendAt, timeZone, postData.Priority)
+}
+
+// sendOrSchedule sends the messages of a /sendsms request, or schedules them if
+// sendAt is set.  Suppressed numbers are removed, unless the priority is
+// emergency.  Messages to recipients whose send window is closed at that time
+// are deferred to the next opening of the window, and listed separately in the
+// response.
+func (s *MessagingServer) sendOrSchedule(w http.ResponseWriter, t Template, identity string, rms []RecipientMessage, numbers []MSISDNInputs, invalid int, sendAt time.Time, timeZone, priority string) {
+	at := sendAt
+	if at.IsZero() {
+		at = time.Now().UTC()
+	}
+	allowed, suppressed, err := s.filterSuppressed(rms, priority)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now, deferred, err := s.ScheduleOutsideWindows(t, identity, allowed, at, priority)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
 
 	sendR := sendSMSResponse{
-		RefNumber:         sendID,
-		ValidNumbers:      len(cns),
-		InvalidNumbers:    len(postData.MSISDNS) - len(cns),
-		SendSuccess:       false,
-		StatusDescription: "",
-		MessagesSent:      0,
+		ValidNumbers:      len(rms),
+		InvalidNumbers:    invalid,
+		SuppressedNumbers: suppressed,
+		Batches:           []BatchResult{},
+		Deferred:          deferred,
+		Numbers:           numbers,
+	}
+	for _, ss := range deferred {
+		sendR.MessagesDeferred += ss.Recipients
+	}
+	switch {
+	case len(now) == 0 && len(deferred) == 0 && suppressed > 0:
+		err = errors.New("All recipients are suppressed")
+	case len(now) == 0 && len(deferred) == 0:
+		err = errors.New("No valid recipients")
+	case len(now) == 0:
+		// Every message was deferred
+	case !sendAt.IsZero():
+		var ss ScheduledSend
+		if ss, err = s.ScheduleSMS(t, identity, now, sendAt, timeZone, priority); err == nil {
+			sendR.Scheduled = &ss
+		}
+	default:
+		var res SendResult
+		res, err = s.sendRendered(t, identity, now)
+		sendR.RefNumber = res.CampaignID
+		sendR.MessagesSent = res.MessagesSent()
+		sendR.MessagesQueued = res.Queued
+		if res.Batches != nil {
+			sendR.Batches = res.Batches
+		}
 	}
 	if err == nil {
 		sendR.SendSuccess = true
-		sendR.MessagesSent = len(cns) // Assuming sending only one message per MSISDN
 	} else {
 		sendR.StatusDescription = err.Error()
+		if len(now) > 0 && len(deferred) > 0 {
+			// The request failed, so a retry must not send the deferred messages again
+			s.cancelDeferred(deferred)
+			sendR.Deferred = nil
+			sendR.MessagesDeferred = 0
+		}
 	}
 	js, err := json.Marshal(sendR)
 	if err != nil {
@@ -107,45 +317,331 @@ func (s *MessagingServer) handleSendSMS(w http.ResponseWriter, r *http.Request,
 	w.Write(js)
 }
 
-// HandleMessageStatus retrieves the delivery status for the last message delivered
-// to a mobile number.
-func (s *MessagingServer) handleMessageStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// HandleSendEmail sends an email to a list of addresses.  Invalid and duplicate
+// addresses are removed before sending.
+func (s *MessagingServer) handleSendEmail(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, identity := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var postData EmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&postData); err != nil {
+		http.Error(w, "Invalid email json data", http.StatusNotAcceptable)
+		return
+	}
+	if postData.Subject == "" || (postData.Text == "" && postData.HTML == "") || len(postData.Addresses) == 0 {
+		http.Error(w, "Invalid subject, message or address data", http.StatusNotAcceptable)
+		return
+	}
+
+	as := cleanEmailAddresses(postData.Addresses)
+	e := Email{Subject: postData.Subject, Text: postData.Text, HTML: postData.HTML}
+	res, err := s.SendEmailMessages(e, identity, as)
+
+	sendR := sendEmailResponse{
+		RefNumber:        res.CampaignID,
+		ValidAddresses:   len(as),
+		InvalidAddresses: len(postData.Addresses) - len(as),
+		MessagesSent:     res.MessagesSent(),
+		Batches:          res.Batches,
+	}
+	if err == nil {
+		sendR.SendSuccess = true
+	} else {
+		sendR.StatusDescription = err.Error()
+	}
+	js, err := json.Marshal(sendR)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// SuppressionRequest is the body of a request to add numbers to the suppression list
+type SuppressionRequest struct {
+	MSISDNS []string `json:"msisdns"`
+	Reason  string   `json:"reason"`
+}
+
+// HandleListSuppressions returns the suppression list
+func (s *MessagingServer) handleListSuppressions(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	userAuth, _ := userHasPermission(s, r)
 	if userAuth != true {
 		http.Error(w, "User unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	n := ps.ByName("msisdn")
-	st, err := s.GetNumberStatus(n)
+	sups, err := s.DB.listSuppressions()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprintf(w, "%v", st)
+	js, err := json.Marshal(sups)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
 }
 
-// HandleNormalize expects a comma separated list of mobile numbers which it would
-// then run through a series of operations to validate, clean up and remove
-// duplicates.  It returns a JSON list of valid numbers.
-func (s *MessagingServer) handleNormalize(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// HandleAddSuppressions adds numbers to the suppression list, and returns the
+// cleaned numbers that were added.
+func (s *MessagingServer) handleAddSuppressions(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, identity := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var postData SuppressionRequest
+	if err := json.NewDecoder(r.Body).Decode(&postData); err != nil || len(postData.MSISDNS) == 0 {
+		http.Error(w, "Invalid msisdn json data", http.StatusNotAcceptable)
+		return
+	}
+	ns, err := s.SuppressNumbers(postData.MSISDNS, postData.Reason, suppressionManual, identity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(ns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleRemoveSuppression removes a number from the suppression list
+func (s *MessagingServer) handleRemoveSuppression(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	userAuth, _ := userHasPermission(s, r)
 	if userAuth != true {
 		http.Error(w, "User unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	var postData SMSRequest
-	err := json.NewDecoder(r.Body).Decode(&postData)
+	if err := s.UnsuppressNumber(ps.ByName("msisdn")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// NormalizeResponse is the detailed response of /normalize
+type NormalizeResponse struct {
+	MSISDNS []string           `json:"msisdns"` // The valid numbers, in the order of the request
+	Mapping []MSISDNInputs     `json:"mapping"` // The valid numbers, with the positions of all the numbers in the request that were cleaned to them
+	Numbers []NormalizedNumber `json:"numbers"` // The outcome of every number in the request
+}
+
+// GroupRequest is the body of a request to create a recipient group
+type GroupRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// GroupMembersRequest is the body of a request to import members into a group.
+// Numbers in msisdns are added without variables.
+type GroupMembersRequest struct {
+	MSISDNS []string    `json:"msisdns"`
+	Members []Recipient `json:"members"`
+}
+
+// HandleListGroups returns every recipient group
+func (s *MessagingServer) handleListGroups(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
 
+	gs, err := s.DB.listGroups()
 	if err != nil {
-		http.Error(w, "Invalid message or msisdn json data", http.StatusNotAcceptable)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(gs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleCreateGroup creates an empty recipient group
+func (s *MessagingServer) handleCreateGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, identity := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var postData GroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&postData); err != nil {
+		http.Error(w, "Invalid group json data", http.StatusNotAcceptable)
+		return
+	}
+	g, err := s.CreateGroup(postData.Name, postData.Description, identity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	js, err := json.Marshal(g)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleGetGroup returns a recipient group along with its members
+func (s *MessagingServer) handleGetGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	g, err := s.DB.getGroup(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	ms, err := s.DB.groupMembers([]string{g.ID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(struct {
+		RecipientGroup
+		Recipients []Recipient `json:"recipients"`
+	}{g, ms})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleDeleteGroup deletes a recipient group and its members
+func (s *MessagingServer) handleDeleteGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.DB.deleteGroup(ps.ByName("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleImportGroupMembers adds members to a recipient group, and reports how
+// many were imported along with the numbers that were invalid.
+func (s *MessagingServer) handleImportGroupMembers(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var postData GroupMembersRequest
+	if err := json.NewDecoder(r.Body).Decode(&postData); err != nil {
+		http.Error(w, "Invalid member json data", http.StatusNotAcceptable)
+		return
+	}
+	rs := postData.Members
+	for _, n := range postData.MSISDNS {
+		rs = append(rs, Recipient{MSISDN: n})
+	}
+	if len(rs) == 0 {
+		http.Error(w, "Invalid member data", http.StatusNotAcceptable)
+		return
+	}
+	if _, err := s.DB.getGroup(ps.ByName("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	res, err := s.ImportGroupMembers(ps.ByName("id"), rs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleRemoveGroupMember removes a number from a recipient group
+func (s *MessagingServer) handleRemoveGroupMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ns := cleanMSISDNs([]string{ps.ByName("msisdn")}, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)
+	if len(ns) == 0 {
+		http.Error(w, "Invalid msisdn", http.StatusNotAcceptable)
+		return
+	}
+	if err := s.DB.removeGroupMember(ps.ByName("id"), ns[0]); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// maxUploadSize is the largest recipient list that can be uploaded
+const maxUploadSize = 32 << 20
+
+// HandleUploadRecipients reads a CSV recipient list from the 'file' part of a
+// multipart form, and returns a report of the outcome of every row.  Nothing is
+// sent; the valid recipients in the report can be sent with /sendsms.
+func (s *MessagingServer) handleUploadRecipients(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		http.Error(w, "Invalid multipart form data", http.StatusNotAcceptable)
+		return
+	}
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "The form has no file", http.StatusNotAcceptable)
 		return
 	}
+	defer f.Close()
 
-	cleanMSISDNs := cleanMSISDNs(postData.MSISDNS, s.Config.SMSProvider.Countries)
-	js, err := json.Marshal(cleanMSISDNs)
+	opts, err := parseCSVOptions(r.FormValue("delimiter"), r.FormValue("header"), r.FormValue("msisdnColumn"), r.FormValue("variables"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	rep, err := s.ParseRecipientCSV(f, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	js, err := json.Marshal(rep)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -154,6 +650,651 @@ func (s *MessagingServer) handleNormalize(w http.ResponseWriter, r *http.Request
 	w.Write(js)
 }
 
+// HandleListSends returns a page of the send history.  See parseHistoryQuery
+// for the query parameters.
+func (s *MessagingServer) handleListSends(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	p, err := s.GetHistory(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleGetSend returns a batch from the send history, along with the current
+// status of each of its messages.
+func (s *MessagingServer) handleGetSend(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	d, err := s.DB.getSendLog(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	js, err := json.Marshal(d)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleListSchedules returns the scheduled sends with the status given in the
+// 'status' query parameter, which defaults to pending.  Use 'all' for every status.
+func (s *MessagingServer) handleListSchedules(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = schedulePending
+	case "all":
+		status = ""
+	}
+	sss, err := s.DB.listSchedules(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(sss)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleGetSchedule returns a scheduled send
+func (s *MessagingServer) handleGetSchedule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ss, err := s.DB.getSchedule(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.writeSchedule(w, ss)
+}
+
+// HandleReschedule changes the delivery time of a pending scheduled send
+func (s *MessagingServer) handleReschedule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var postData RescheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&postData); err != nil {
+		http.Error(w, "Invalid schedule json data", http.StatusNotAcceptable)
+		return
+	}
+	sendAt, timeZone, err := parseSendAt(postData.SendAt, postData.TimeZone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	ss, err := s.RescheduleSMS(ps.ByName("id"), sendAt, timeZone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	s.writeSchedule(w, ss)
+}
+
+// HandleCancelSchedule cancels a pending scheduled send
+func (s *MessagingServer) handleCancelSchedule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.DB.cancelSchedule(ps.ByName("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *MessagingServer) writeSchedule(w http.ResponseWriter, ss ScheduledSend) {
+	js, err := json.Marshal(ss)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleListTemplates returns the latest version of every template
+func (s *MessagingServer) handleListTemplates(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.writeTemplates(w, r, "")
+}
+
+// HandleTemplateVersions returns every version of a template, latest first
+func (s *MessagingServer) handleTemplateVersions(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.writeTemplates(w, r, ps.ByName("name"))
+}
+
+func (s *MessagingServer) writeTemplates(w http.ResponseWriter, r *http.Request, name string) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ts, err := s.DB.listTemplates(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if name != "" && len(ts) == 0 {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	js, err := json.Marshal(ts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleGetTemplate returns the latest version of a template, or the version
+// given in the 'version' query parameter.
+func (s *MessagingServer) handleGetTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid template version", http.StatusNotAcceptable)
+			return
+		}
+	}
+	t, err := s.GetTemplate(ps.ByName("name"), version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.writeTemplate(w, t)
+}
+
+// HandleCreateTemplate stores the first version of a new template
+func (s *MessagingServer) handleCreateTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, identity := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var postData TemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&postData); err != nil {
+		http.Error(w, "Invalid template json data", http.StatusNotAcceptable)
+		return
+	}
+	if _, err := s.GetTemplate(postData.Name, 0); err == nil {
+		http.Error(w, "Template already exists", http.StatusConflict)
+		return
+	}
+	t, err := s.SaveTemplate(postData.Name, postData.Body, identity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	s.writeTemplate(w, t)
+}
+
+// HandleUpdateTemplate stores a new version of an existing template
+func (s *MessagingServer) handleUpdateTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, identity := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var postData TemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&postData); err != nil {
+		http.Error(w, "Invalid template json data", http.StatusNotAcceptable)
+		return
+	}
+	name := ps.ByName("name")
+	if _, err := s.GetTemplate(name, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	t, err := s.SaveTemplate(name, postData.Body, identity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	s.writeTemplate(w, t)
+}
+
+// HandleDeleteTemplate deletes every version of a template
+func (s *MessagingServer) handleDeleteTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.DB.deleteTemplate(ps.ByName("name")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *MessagingServer) writeTemplate(w http.ResponseWriter, t Template) {
+	js, err := json.Marshal(t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleMessageStatus retrieves the delivery status for the last message delivered
+// to a mobile number.
+func (s *MessagingServer) handleMessageStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	n := ps.ByName("msisdn")
+	st, err := s.GetNumberStatus(n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%v", st)
+}
+
+// HandleProviderMessageStatus retrieves the status of a message by the ID that
+// the provider assigned to it.
+func (s *MessagingServer) handleProviderMessageStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ms, err := s.GetMessageStatus(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	js, err := json.Marshal(ms)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleNumberMessageStatus retrieves the status of the last message sent to a
+// mobile number.  Unlike /messagestatus, the number is cleaned first, and the
+// status is returned as JSON.
+func (s *MessagingServer) handleNumberMessageStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ns := cleanMSISDNs([]string{ps.ByName("msisdn")}, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)
+	if len(ns) == 0 {
+		http.Error(w, "Invalid msisdn", http.StatusNotAcceptable)
+		return
+	}
+	ms, err := s.GetLastMessageStatus(ns[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	js, err := json.Marshal(ms)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// MessageStatusRequest is the body of a request to set the status of a message
+type MessageStatusRequest struct {
+	Status      string `json:"status"`
+	Description string `json:"description"`
+}
+
+// HandleMessageTimeline retrieves a message along with every status that was
+// received for it, by its sms ID.
+func (s *MessagingServer) handleMessageTimeline(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	mt, err := s.GetMessageTimeline(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	js, err := json.Marshal(mt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleSetMessageStatus sets the final status of a message by its sms ID
+func (s *MessagingServer) handleSetMessageStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var postData MessageStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&postData); err != nil {
+		http.Error(w, "Invalid status json data", http.StatusNotAcceptable)
+		return
+	}
+	if _, err := s.DB.getMessageStatusByID(ps.ByName("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := s.SetMessageStatus(ps.ByName("id"), postData.Status, postData.Description); err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleCampaignStatus retrieves the progress of a campaign, using the reference
+// number returned by /sendsms.
+func (s *MessagingServer) handleCampaignStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cs, err := s.GetCampaignStatus(ps.ByName("refNumber"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	js, err := json.Marshal(cs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleBreakers returns the state of the circuit breaker of each provider that
+// has failover configured.
+func (s *MessagingServer) handleBreakers(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Make sure that breakers that have not been used yet are also listed
+	for _, p := range s.Config.providers() {
+		s.Breakers.get(p)
+	}
+	js, err := json.Marshal(s.Breakers.Status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleNormalize expects a comma separated list of mobile numbers which it would
+// then run through a series of operations to validate, clean up and remove
+// duplicates.  It returns a JSON list of valid numbers, or if the 'detail' query
+// parameter is true, a NormalizeResponse describing the outcome of every number.
+func (s *MessagingServer) handleNormalize(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var postData SMSRequest
+	err := json.NewDecoder(r.Body).Decode(&postData)
+
+	if err != nil {
+		http.Error(w, "Invalid message or msisdn json data", http.StatusNotAcceptable)
+		return
+	}
+
+	var js []byte
+	if detail, _ := strconv.ParseBool(r.URL.Query().Get("detail")); detail {
+		res := NormalizeResponse{MSISDNS: []string{}, Mapping: []MSISDNInputs{}, Numbers: normalizeReport(postData.MSISDNS, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)}
+		pos := map[string]int{}
+		for _, nn := range res.Numbers {
+			if nn.Valid {
+				pos[nn.MSISDN] = len(res.Mapping)
+				res.MSISDNS = append(res.MSISDNS, nn.MSISDN)
+				res.Mapping = append(res.Mapping, MSISDNInputs{MSISDN: nn.MSISDN, Inputs: []int{nn.Index}})
+			} else if nn.DuplicateOf != nil {
+				p := pos[nn.MSISDN]
+				res.Mapping[p].Inputs = append(res.Mapping[p].Inputs, nn.Index)
+			}
+		}
+		js, err = json.Marshal(res)
+	} else {
+		cleanMSISDNs := cleanMSISDNs(postData.MSISDNS, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)
+		js, err = json.Marshal(cleanMSISDNs)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleMessageInfo returns the encoding, length and number of segments of a
+// message, whether it may be sent, and the estimated cost of sending it.  It is
+// intended for a live character counter while a message is typed.
+func (s *MessagingServer) handleMessageInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, identity := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var postData MessageInfoRequest
+	if err := json.NewDecoder(r.Body).Decode(&postData); err != nil {
+		http.Error(w, "Invalid message json data", http.StatusNotAcceptable)
+		return
+	}
+
+	var ns []string
+	if postData.MSISDNS != nil {
+		ns = cleanMSISDNs(postData.MSISDNS, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)
+	}
+	info := s.GetMessageInfo(postData.Message, identity, ns, postData.Recipients)
+	js, err := json.Marshal(info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// HandleClickatellCallback receives delivery receipts pushed by Clickatell.  The
+// caller is not a user, so instead of user authentication the request must
+// contain the configured shared secret, either as the 'secret' query parameter
+// or in the X-Callback-Secret header.
+func (s *MessagingServer) handleClickatellCallback(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !s.callbackAuthorized("Clickatell", r) {
+		http.Error(w, "Callback unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cb, err := clickatell.ParseCallback(r)
+	if err != nil {
+		http.Error(w, "Invalid callback data", http.StatusNotAcceptable)
+		return
+	}
+
+	if err := (ClickatellSender{}).HandleCallback(s, cb); err == errUnknownMessage {
+		// Retrying would not help if we don't know the message, so it is acknowledged and ignored
+		s.Log.Warnf("Clickatell callback for message %v: %v", cb.APIMessageID, err)
+	} else if err != nil {
+		// An error status allows Clickatell to retry the callback
+		s.Log.Errorf("Clickatell callback for message %v: %v", cb.APIMessageID, err)
+		http.Error(w, "Could not store delivery status", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleClickatellInbound receives replies pushed by Clickatell.  It is
+// authenticated with the same secret as delivery callbacks.
+func (s *MessagingServer) handleClickatellInbound(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !s.callbackAuthorized("Clickatell", r) {
+		http.Error(w, "Callback unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	m, err := clickatell.ParseInbound(r)
+	if err != nil {
+		http.Error(w, "Invalid reply data", http.StatusNotAcceptable)
+		return
+	}
+
+	in := InboundSMS{MSISDN: m.From, To: m.To, Message: m.Text, Provider: "Clickatell", ProviderID: m.MessageID}
+	if _, err := s.ReceiveSMS(in); err == errInvalidReply {
+		// Retrying would not help, so the reply is acknowledged and ignored
+		s.Log.Warnf("Clickatell reply %v from %v: %v", m.MessageID, m.From, err)
+	} else if err != nil {
+		// An error status allows Clickatell to retry the callback
+		s.Log.Errorf("Clickatell reply %v from %v: %v", m.MessageID, m.From, err)
+		http.Error(w, "Could not store reply", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleListInbound returns the most recent replies, optionally only those from
+// the number in the 'msisdn' query parameter.  The 'limit' query parameter
+// defaults to 100.
+func (s *MessagingServer) handleListInbound(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userAuth, _ := userHasPermission(s, r)
+	if userAuth != true {
+		http.Error(w, "User unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	n := ""
+	if q.Get("msisdn") != "" {
+		ns := cleanMSISDNs([]string{q.Get("msisdn")}, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)
+		if len(ns) == 0 {
+			http.Error(w, "Invalid msisdn", http.StatusNotAcceptable)
+			return
+		}
+		n = ns[0]
+	}
+	limit := 100
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusNotAcceptable)
+			return
+		}
+	}
+	ins, err := s.DB.listInbound(n, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(ins)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// callbackAuthorized checks the callback secret against each of the providers
+// of the given type that accept callbacks.
+func (s *MessagingServer) callbackAuthorized(name string, r *http.Request) bool {
+	secret := r.URL.Query().Get("secret")
+	if secret == "" {
+		secret = r.Header.Get("X-Callback-Secret")
+	}
+	for _, p := range s.Config.providers() {
+		c := p.Callback
+		if p.Name != name || !c.Enabled || c.Secret == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(c.Secret)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *MessagingServer) handlePing(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprintf(w, "{\"Timestamp\": %v}", time.Now().Unix())
@@ -0,0 +1,404 @@
+package messaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+func init() {
+	RegisterSender("HTTP", newHTTPSender)
+}
+
+// ConfigHTTPProvider defines the API of a gateway that accepts messages as a
+// simple HTTP request.  It is read from the "http" field of the provider's
+// config block.
+//
+// The URL, headers and body are Go templates, executed with httpTemplateData.
+// Besides the standard template functions, "json" encodes a value as JSON and
+// "join" joins a list of strings with a separator.
+type ConfigHTTPProvider struct {
+	URL         string
+	Method      string            // Defaults to POST
+	Headers     map[string]string // Header values are templates
+	ContentType string            // Defaults to application/json
+	Body        string
+	Batch       bool   // Send one request per batch instead of one per recipient
+	Timeout     string // Defaults to 30s
+	Response    ConfigHTTPResponse
+	Status      *ConfigHTTPStatus // Optional, retrieves the delivery status of a message
+}
+
+// ConfigHTTPResponse defines where the results are found in a JSON response.
+// Paths are field names separated by dots, with array elements selected by
+// their index, e.g. "data.messages.0.id".
+type ConfigHTTPResponse struct {
+	Messages         string   // Path of the list of per-recipient results, for batch requests. Without it, the result applies to every recipient
+	To               string   // Path of the recipient, within a per-recipient result
+	MessageID        string   // Path of the provider's message ID
+	ErrorCode        string   // Path of the error code
+	ErrorDescription string   // Path of the error description
+	Segments         string   // Path of the number of segments
+	SuccessCodes     []string // Error codes that indicate success. Defaults to "" and "0"
+}
+
+// ConfigHTTPStatus defines the request that retrieves the delivery status of a
+// message, and how the provider's status values map to delivered, failed and sent.
+type ConfigHTTPStatus struct {
+	URL         string
+	Method      string // Defaults to GET
+	Headers     map[string]string
+	ContentType string
+	Body        string
+	Response    ConfigHTTPResponse
+	StatusPath  string            // Path of the status value in the response
+	StatusMap   map[string]string // Provider status to delivered or failed. Unmapped values are treated as sent
+}
+
+// httpTemplateData is available to the URL, header and body templates
+type httpTemplateData struct {
+	To         string   // The recipient, for per-recipient requests
+	Recipients []string // All of the recipients in the batch
+	Text       string
+	From       string
+	Token      string
+	Encoding   string // "gsm7" or "ucs2"
+	Unicode    bool   // True if the text must be sent as UCS-2
+	MessageID  string // The provider's message ID, for status requests
+}
+
+// HTTPSender sends messages through a gateway that is defined entirely in the config
+type HTTPSender struct {
+	config ConfigHTTPProvider
+	client *http.Client
+	url    *template.Template
+	header map[string]*template.Template
+	body   *template.Template
+	status *httpStatusRequest
+}
+
+type httpStatusRequest struct {
+	url    *template.Template
+	header map[string]*template.Template
+	body   *template.Template
+}
+
+// httpStatusError is returned when the gateway responds with an unsuccessful HTTP status
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP provider: %v", e.Status)
+}
+
+// ErrorCode returns the HTTP status code
+func (e *httpStatusError) ErrorCode() string {
+	return strconv.Itoa(e.StatusCode)
+}
+
+// httpMessageError is returned when the gateway rejects a message with an error code
+type httpMessageError struct {
+	Code        string
+	Description string
+}
+
+func (e *httpMessageError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// ErrorCode returns the gateway's error code
+func (e *httpMessageError) ErrorCode() string {
+	return e.Code
+}
+
+var httpTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": func(sep string, v []string) string {
+		return strings.Join(v, sep)
+	},
+}
+
+func newHTTPSender(raw json.RawMessage) (SMSSender, error) {
+	var c struct {
+		HTTP ConfigHTTPProvider
+	}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, err
+	}
+	hc := c.HTTP
+	if hc.URL == "" {
+		return nil, errors.New("http.url is not configured")
+	}
+	if hc.Method == "" {
+		hc.Method = "POST"
+	}
+	if hc.ContentType == "" {
+		hc.ContentType = "application/json"
+	}
+	to, err := time.ParseDuration(hc.Timeout)
+	if err != nil || hc.Timeout == "" {
+		to = 30 * time.Second
+	}
+
+	h := &HTTPSender{config: hc, client: &http.Client{Timeout: to}}
+	if h.url, h.header, h.body, err = parseHTTPTemplates(hc.URL, hc.Headers, hc.Body); err != nil {
+		return nil, err
+	}
+	if hc.Status != nil {
+		if hc.Status.Method == "" {
+			hc.Status.Method = "GET"
+		}
+		h.status = &httpStatusRequest{}
+		if h.status.url, h.status.header, h.status.body, err = parseHTTPTemplates(hc.Status.URL, hc.Status.Headers, hc.Status.Body); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func parseHTTPTemplates(url string, headers map[string]string, body string) (*template.Template, map[string]*template.Template, *template.Template, error) {
+	ut, err := template.New("url").Funcs(httpTemplateFuncs).Parse(url)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hts := map[string]*template.Template{}
+	for k, v := range headers {
+		if hts[k], err = template.New(k).Funcs(httpTemplateFuncs).Parse(v); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	bt, err := template.New("body").Funcs(httpTemplateFuncs).Parse(body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ut, hts, bt, nil
+}
+
+// SendSMS sends the message either as a single request for the batch, or as a
+// request per recipient.  Messages are only reported as failed if every
+// recipient was rejected, in which case the first error is returned.
+func (h *HTTPSender) SendSMS(s *MessagingServer, m Message) ([]SendSMSResponseMessage, error) {
+	td := httpTemplateData{
+		Recipients: m.Destination,
+		Text:       m.Text,
+		From:       m.From,
+		Token:      m.Provider.Token,
+		Encoding:   m.Encoding,
+		Unicode:    m.Encoding == EncodingUCS2,
+	}
+
+	var msRess []SendSMSResponseMessage
+	if h.config.Batch {
+		resp, err := h.do(h.config.Method, h.config.ContentType, h.url, h.header, h.body, td)
+		if err != nil {
+			return nil, err
+		}
+		if h.config.Response.Messages == "" {
+			// The response describes the whole batch, so it applies to every recipient
+			msRes := h.config.Response.result(resp)
+			for _, n := range m.Destination {
+				msRes.To = n
+				msRess = append(msRess, msRes)
+			}
+		} else {
+			v, _ := jsonPath(resp, h.config.Response.Messages)
+			items, _ := v.([]interface{})
+			if len(items) == 0 {
+				return nil, errors.New("HTTP provider: Response does not contain a list of messages at " + h.config.Response.Messages)
+			}
+			for i, it := range items {
+				msRes := h.config.Response.result(it)
+				if msRes.To == "" && i < len(m.Destination) {
+					msRes.To = m.Destination[i]
+				}
+				msRess = append(msRess, msRes)
+			}
+		}
+	} else {
+		for _, n := range m.Destination {
+			td.To = n
+			resp, err := h.do(h.config.Method, h.config.ContentType, h.url, h.header, h.body, td)
+			if err != nil {
+				return msRess, err
+			}
+			msRes := h.config.Response.result(resp)
+			msRes.To = n
+			msRess = append(msRess, msRes)
+		}
+	}
+
+	for _, r := range msRess {
+		if r.sent() {
+			return msRess, nil
+		}
+	}
+	if len(msRess) > 0 {
+		return msRess, &httpMessageError{msRess[0].ErrorCode, msRess[0].ErrorDesc}
+	}
+	return msRess, nil
+}
+
+// GetStatus retrieves the status of a message, if a status request is configured
+func (h *HTTPSender) GetStatus(s *MessagingServer, m Message) ([]SendSMSResponseMessage, error) {
+	if h.status == nil {
+		return nil, errors.New("HTTP provider: status request is not configured")
+	}
+	sc := h.config.Status
+	td := httpTemplateData{MessageID: m.ProviderID, Token: m.Provider.Token}
+	resp, err := h.do(sc.Method, sc.ContentType, h.status.url, h.status.header, h.status.body, td)
+	if err != nil {
+		return nil, err
+	}
+
+	msRes := sc.Response.result(resp)
+	msRes.MessageID = m.ProviderID
+	st, _ := jsonPathString(resp, sc.StatusPath)
+	msRes.ErrorDesc = st
+	msRes.RawStatus = st
+	msRes.ErrorCode = Sent
+	if mapped, ok := sc.StatusMap[st]; ok {
+		msRes.ErrorCode = mapped
+	}
+	return []SendSMSResponseMessage{msRes}, nil
+}
+
+// do executes a request built from the templates, and decodes the JSON response
+func (h *HTTPSender) do(method, contentType string, ut *template.Template, hts map[string]*template.Template, bt *template.Template, td httpTemplateData) (interface{}, error) {
+	url, err := execTemplate(ut, td)
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader
+	if method != "GET" {
+		b, err := execTemplate(bt, td)
+		if err != nil {
+			return nil, err
+		}
+		body = strings.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, t := range hts {
+		v, err := execTemplate(t, td)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, &httpStatusError{resp.StatusCode, resp.Status}
+	}
+
+	var res interface{}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&res); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("HTTP provider: invalid response: %v", err)
+	}
+	return res, nil
+}
+
+func execTemplate(t *template.Template, td httpTemplateData) (string, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, td); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// result reads the outcome of a single message from a decoded response
+func (r ConfigHTTPResponse) result(v interface{}) SendSMSResponseMessage {
+	msRes := SendSMSResponseMessage{}
+	msRes.To, _ = jsonPathString(v, r.To)
+	msRes.MessageID, _ = jsonPathString(v, r.MessageID)
+	msRes.ErrorCode, _ = jsonPathString(v, r.ErrorCode)
+	msRes.ErrorDesc, _ = jsonPathString(v, r.ErrorDescription)
+	if seg, ok := jsonPathString(v, r.Segments); ok {
+		msRes.Segments, _ = strconv.Atoi(seg)
+	}
+
+	// Normalise the gateway's success codes to the code used by the other providers
+	codes := r.SuccessCodes
+	if len(codes) == 0 {
+		codes = []string{"", "0"}
+	}
+	for _, c := range codes {
+		if msRes.ErrorCode == c {
+			msRes.ErrorCode = ""
+			break
+		}
+	}
+	if msRes.ErrorCode != "" && msRes.ErrorCode != "0" && msRes.ErrorDesc == "" {
+		msRes.ErrorDesc = msRes.ErrorCode
+	}
+	return msRes
+}
+
+// jsonPath finds a value in a decoded JSON document.  The path consists of
+// object keys and array indexes, separated by dots.
+func jsonPath(v interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return nil, false
+	}
+	for _, p := range strings.Split(path, ".") {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = t[p]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			v = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// jsonPathString finds a scalar value in a decoded JSON document and returns it as a string
+func jsonPathString(v interface{}, path string) (string, bool) {
+	r, ok := jsonPath(v, path)
+	if !ok || r == nil {
+		return "", false
+	}
+	switch t := r.(type) {
+	case string:
+		return t, true
+	case json.Number:
+		return t.String(), true
+	case bool:
+		return strconv.FormatBool(t), true
+	}
+	return "", false
+}
@@ -0,0 +1,202 @@
+package messaging
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/IMQS/log"
+)
+
+// httpStub is a gateway that accepts messages for one or more recipients, and
+// counts the messages accepted for each recipient.
+type httpStub struct {
+	mu       sync.Mutex
+	requests int
+	accepted map[string]int
+	fail     func(request int) bool // Responds with 503 Service Unavailable if it returns true
+	body     interface{}            // Response body instead of the per-recipient results, if set
+}
+
+func (g *httpStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		To   []string `json:"to"`
+		Text string   `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests++
+	if g.fail != nil && g.fail(g.requests) {
+		http.Error(w, "Busy", http.StatusServiceUnavailable)
+		return
+	}
+	if g.body != nil {
+		for _, n := range req.To {
+			g.accepted[n]++
+		}
+		json.NewEncoder(w).Encode(g.body)
+		return
+	}
+	type result struct {
+		To string `json:"to"`
+		ID string `json:"id"`
+	}
+	var res []result
+	for _, n := range req.To {
+		g.accepted[n]++
+		res = append(res, result{To: n, ID: "id-" + n})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"messages": res})
+}
+
+func newTestHTTPSender(t *testing.T, url string, batch bool) SMSSender {
+	resp := ConfigHTTPResponse{Messages: "messages", To: "to", MessageID: "id"}
+	if !batch {
+		resp = ConfigHTTPResponse{To: "messages.0.to", MessageID: "messages.0.id"}
+	}
+	return newTestHTTPSenderResponse(t, url, batch, resp)
+}
+
+func newTestHTTPSenderResponse(t *testing.T, url string, batch bool, resp ConfigHTTPResponse) SMSSender {
+	body := `{"to": {{json .Recipients}}, "text": {{json .Text}}}`
+	if !batch {
+		body = `{"to": [{{json .To}}], "text": {{json .Text}}}`
+	}
+	raw, _ := json.Marshal(map[string]interface{}{
+		"http": ConfigHTTPProvider{URL: url, Body: body, Batch: batch, Response: resp},
+	})
+	h, err := newHTTPSender(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testServer() *MessagingServer {
+	return &MessagingServer{Log: log.New(log.Stdout)}
+}
+
+func testMessage(ns ...string) Message {
+	return Message{
+		Destination: ns,
+		Text:        "Water supply interrupted",
+		Provider:    ConfigSmsProvider{Retry: ConfigRetry{MaxAttempts: 3, InitialBackoff: "1ms", MaxBackoff: "1ms"}},
+	}
+}
+
+func TestHTTPSenderBatch(t *testing.T) {
+	g := &httpStub{accepted: map[string]int{}}
+	ts := httptest.NewServer(g)
+	defer ts.Close()
+
+	ns := []string{"27830000001", "27830000002", "27830000003"}
+	resp, attempts, err := sendWithRetry(testServer(), newTestHTTPSender(t, ts.URL, true), testMessage(ns...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.requests != 1 || len(attempts) != 1 {
+		t.Errorf("Expected a single request, got %v requests and %v attempts", g.requests, len(attempts))
+	}
+	if len(resp) != len(ns) {
+		t.Fatalf("Expected %v results, got %v", len(ns), len(resp))
+	}
+	for i, r := range resp {
+		if r.To != ns[i] || r.MessageID != "id-"+ns[i] || !r.sent() {
+			t.Errorf("Unexpected result %+v for %v", r, ns[i])
+		}
+	}
+}
+
+func TestHTTPSenderBatchResponse(t *testing.T) {
+	ns := []string{"27830000001", "27830000002", "27830000003"}
+	cases := []struct {
+		name     string
+		messages string      // Response.Messages path
+		body     interface{} // Gateway response
+		wantErr  bool
+	}{
+		{"single result", "", map[string]interface{}{"id": "batch-1"}, false},
+		{"missing list", "messages", map[string]interface{}{"id": "batch-1"}, true},
+		{"not a list", "messages", map[string]interface{}{"messages": "queued"}, true},
+	}
+	for _, c := range cases {
+		g := &httpStub{accepted: map[string]int{}, body: c.body}
+		ts := httptest.NewServer(g)
+		h := newTestHTTPSenderResponse(t, ts.URL, true, ConfigHTTPResponse{Messages: c.messages, MessageID: "id"})
+		resp, err := h.SendSMS(testServer(), testMessage(ns...))
+		ts.Close()
+		if c.wantErr {
+			if err == nil || len(resp) != 0 {
+				t.Errorf("%v: Expected an error, got %+v, %v", c.name, resp, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if len(resp) != len(ns) {
+			t.Fatalf("%v: Expected %v results, got %+v", c.name, len(ns), resp)
+		}
+		for i, r := range resp {
+			if r.To != ns[i] || r.MessageID != "batch-1" || !r.sent() {
+				t.Errorf("%v: Unexpected result %+v for %v", c.name, r, ns[i])
+			}
+		}
+	}
+}
+
+func TestHTTPSenderPerRecipient(t *testing.T) {
+	// The second request fails, after the first recipient was accepted
+	g := &httpStub{accepted: map[string]int{}, fail: func(r int) bool { return r == 2 }}
+	ts := httptest.NewServer(g)
+	defer ts.Close()
+
+	ns := []string{"27830000001", "27830000002", "27830000003"}
+	resp, attempts, err := sendWithRetry(testServer(), newTestHTTPSender(t, ts.URL, false), testMessage(ns...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Errorf("Expected 2 attempts, got %v", len(attempts))
+	}
+	for _, n := range ns {
+		if g.accepted[n] != 1 {
+			t.Errorf("%v was sent %v messages, expected 1", n, g.accepted[n])
+		}
+	}
+	if len(resp) != len(ns) {
+		t.Fatalf("Expected %v results, got %v", len(ns), len(resp))
+	}
+	for _, r := range resp {
+		if r.MessageID != "id-"+r.To || !r.sent() {
+			t.Errorf("Unexpected result %+v", r)
+		}
+	}
+}
+
+func TestHTTPSenderPerRecipientFailure(t *testing.T) {
+	// Every request after the first fails, until the attempts run out
+	g := &httpStub{accepted: map[string]int{}, fail: func(r int) bool { return r > 1 }}
+	ts := httptest.NewServer(g)
+	defer ts.Close()
+
+	resp, attempts, err := sendWithRetry(testServer(), newTestHTTPSender(t, ts.URL, false), testMessage("27830000001", "27830000002"))
+	if err == nil {
+		t.Fatal("Expected the send to fail")
+	}
+	if len(attempts) != 3 {
+		t.Errorf("Expected 3 attempts, got %v", len(attempts))
+	}
+	if g.accepted["27830000001"] != 1 {
+		t.Errorf("27830000001 was sent %v messages, expected 1", g.accepted["27830000001"])
+	}
+	if len(resp) != 1 || resp[0].To != "27830000001" {
+		t.Errorf("Expected only the accepted recipient in the results, got %+v", resp)
+	}
+}
@@ -0,0 +1,95 @@
+package messaging
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Keywords that opt a number out when no keywords are configured
+var defaultOptOutKeywords = []string{"STOP", "UNSUBSCRIBE"}
+
+// InboundSMS is a reply received from a recipient
+type InboundSMS struct {
+	ID           string    `json:"id"`
+	MSISDN       string    `json:"msisdn"`
+	To           string    `json:"to"` // The number or short code that the reply was sent to
+	Message      string    `json:"message"`
+	ReceivedTime time.Time `json:"receivedTime"`
+	Provider     string    `json:"provider"`
+	ProviderID   string    `json:"providerId"`
+	SMSID        string    `json:"smsId,omitempty"`   // The most recent message sent to the number, which this is presumed to be a reply to
+	Keyword      string    `json:"keyword,omitempty"` // The opt-out keyword, if the reply opted the number out
+}
+
+// optOutKeyword returns the configured keyword that the text starts with, or
+// an empty string.  Case and surrounding punctuation are ignored, so "Stop."
+// matches STOP.
+func (c *ConfigInbound) optOutKeyword(text string) string {
+	fs := strings.Fields(text)
+	if len(fs) == 0 {
+		return ""
+	}
+	w := strings.TrimFunc(fs[0], func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	kws := c.OptOutKeywords
+	if len(kws) == 0 {
+		kws = defaultOptOutKeywords
+	}
+	for _, kw := range kws {
+		if strings.EqualFold(w, kw) {
+			return strings.ToUpper(kw)
+		}
+	}
+	return ""
+}
+
+// errInvalidReply is returned by ReceiveSMS for a reply from a number that is
+// not accepted for any of the configured countries
+var errInvalidReply = errors.New("Invalid msisdn")
+
+// ReceiveSMS stores a reply and links it to the most recent message sent to the
+// number.  A reply that starts with an opt-out keyword adds the number to the
+// suppression list, and is answered with the configured confirmation.
+func (s *MessagingServer) ReceiveSMS(in InboundSMS) (InboundSMS, error) {
+	ns := cleanMSISDNs([]string{in.MSISDN}, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)
+	if len(ns) == 0 {
+		return in, errInvalidReply
+	}
+	in.MSISDN = ns[0]
+	in.ReceivedTime = time.Now().UTC()
+	in.SMSID, _ = s.DB.getLastSMSRowID(in.MSISDN)
+	in.Keyword = s.Config.Inbound.optOutKeyword(in.Message)
+
+	var err error
+	if in.ID, err = s.DB.createInbound(in); err != nil {
+		s.Log.Errorf("Could not store reply from %v: %v", in.MSISDN, err)
+		return in, errors.New("ReceiveSMS DB error")
+	}
+	if in.Keyword == "" {
+		return in, nil
+	}
+
+	s.Log.Infof("Number %v opted out with keyword %v", in.MSISDN, in.Keyword)
+	if _, err := s.SuppressNumbers([]string{in.MSISDN}, "Replied "+in.Keyword, suppressionInbound, ""); err != nil {
+		return in, err
+	}
+	if reply := s.Config.Inbound.ConfirmationReply; reply != "" {
+		// Suppression is only applied to requests, so the confirmation reaches the number.  It is
+		// sent in the background, since retries could outlast the provider's callback timeout.
+		go func(n string) {
+			if _, err := s.SendSMSMessages(reply, s.Config.Inbound.originator(), []string{n}); err != nil {
+				s.Log.Errorf("Could not send opt-out confirmation to %v: %v", n, err)
+			}
+		}(in.MSISDN)
+	}
+	return in, nil
+}
+
+// originator is recorded as the originator of confirmation replies
+func (c *ConfigInbound) originator() string {
+	if c.Originator != "" {
+		return c.Originator
+	}
+	return "inbound"
+}
@@ -2,34 +2,72 @@ package messaging
 
 import "time"
 
+// IntervalService runs the periodic tasks of the service: retrieving the
+// delivery status of messages, and sending scheduled sends when they are due.
 type IntervalService struct {
 	quit chan int
 }
 
 func (is *IntervalService) Stop() {
-	is.quit <- 0
+	if is.quit != nil {
+		is.quit <- 0
+	}
+}
+
+// pollingRequired reports whether any of the providers do not push delivery receipts
+func (s *MessagingServer) pollingRequired() bool {
+	for _, p := range s.Config.providers() {
+		if !s.pushesReceipts(p) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *MessagingServer) startInterval() {
-	if s.Config.DeliveryStatus.Enabled {
+	// A nil channel is never ready, so polling does not run if it is not enabled
+	var statusC <-chan time.Time
+	var statusTicker *time.Ticker
+
+	if s.Config.DeliveryStatus.Enabled && !s.pollingRequired() {
+		s.Log.Infof("Delivery status is pushed by all providers, not polling")
+	} else if s.Config.DeliveryStatus.Enabled {
 		s.Log.Infof("Starting ticker to check delivery status every %v", s.Config.DeliveryStatus.UpdateInterval)
 		d, err := time.ParseDuration(s.Config.DeliveryStatus.UpdateInterval)
 		if err != nil {
 			s.Log.Warnf("Could not start ticker due to invalid time configuration: %v", err.Error())
-			return
+		} else {
+			statusTicker = time.NewTicker(d)
+			statusC = statusTicker.C
 		}
-		ticker := time.NewTicker(d)
-		s.Interval.quit = make(chan int)
-		go func() {
-			for {
-				select {
-				case <-ticker.C:
-					UpdateStatus(s)
-				case <-s.Interval.quit:
-					ticker.Stop()
-					return
+	}
+
+	timeout := parseDurationOrDefault(s.Config.Schedule.ProcessingTimeout, defaultScheduleProcessingTimeout)
+	if n, err := s.DB.failInterruptedSchedules(time.Now().Add(-timeout)); err != nil {
+		s.Log.Errorf("Could not check for interrupted scheduled sends: %v", err)
+	} else if n > 0 {
+		s.Log.Warnf("%v scheduled sends were interrupted by a restart and have been marked as failed", n)
+	}
+	d := parseDurationOrDefault(s.Config.Schedule.CheckInterval, defaultScheduleInterval)
+	s.Log.Infof("Starting ticker to check for scheduled sends every %v", d)
+	scheduleTicker := time.NewTicker(d)
+
+	s.Interval.quit = make(chan int)
+	go func() {
+		s.sendDueSchedules()
+		for {
+			select {
+			case <-statusC:
+				UpdateStatus(s)
+			case <-scheduleTicker.C:
+				s.sendDueSchedules()
+			case <-s.Interval.quit:
+				if statusTicker != nil {
+					statusTicker.Stop()
 				}
+				scheduleTicker.Stop()
+				return
 			}
-		}()
-	}
+		}
+	}()
 }
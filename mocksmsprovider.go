@@ -11,18 +11,19 @@ type MockProviderSender struct {
 
 // SendSMS simulates a SMS provider for testing purposes
 // The messages always succeed with this provider.
-func (p MockProviderSender) SendSMS(s *MessagingServer, m message) ([]SendSMSResponseMessage, error) {
+func (p MockProviderSender) SendSMS(s *MessagingServer, m Message) ([]SendSMSResponseMessage, error) {
 	s.Log.Info("Simulating sending message with MockProviderSendSMS\n")
 	var msRess []SendSMSResponseMessage
 	seed := rand.NewSource(time.Now().UnixNano())
 	random := rand.New(seed)
+	segs := calculateMessage(m.Text).Segments
 	for _, dm := range m.Destination {
 		msRes := SendSMSResponseMessage{
 			To:        dm,
 			MessageID: strconv.Itoa(random.Intn(100000000)),
 			ErrorCode: "0",
 			ErrorDesc: "",
-			Segments:  1,
+			Segments:  segs,
 		}
 		msRess = append(msRess, msRes)
 	}
@@ -30,7 +31,7 @@ func (p MockProviderSender) SendSMS(s *MessagingServer, m message) ([]SendSMSRes
 }
 
 // GetStatus simulates a SMS provider for testing purposes
-func (p MockProviderSender) GetStatus(s *MessagingServer, m message) ([]SendSMSResponseMessage, error) {
+func (p MockProviderSender) GetStatus(s *MessagingServer, m Message) ([]SendSMSResponseMessage, error) {
 	s.Log.Info("Simulating getting status with MockProviderSender GetStatus\n")
 
 	// Randomly succeed, fail or delay messages
@@ -53,6 +54,7 @@ func (p MockProviderSender) GetStatus(s *MessagingServer, m message) ([]SendSMSR
 		ErrorCode: mapCode(errC),
 		ErrorDesc: mapCode(errC),
 		Segments:  1,
+		RawStatus: errC,
 	})
 
 	return msRess, nil
@@ -3,7 +3,9 @@ package messaging
 import (
 	"fmt"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/ttacon/libphonenumber"
 )
@@ -11,27 +13,44 @@ import (
 var isNumbersOnly = regexp.MustCompile(`^[0-9]*$`)
 
 // cleanMSISDNs receives a list of MSISDNs and runs a series
-// of checks to ensure that they are valid mobile numbers for the countries
+// of checks to ensure that they are valid numbers for the countries
 // provided. Invalid and duplicate numbers are ignored and removed from the reply.
-func cleanMSISDNs(ns, cs []string) []string {
-	pNs := []string{}
-
-	for _, n := range ns {
-		// only allow numbers
-		n = numbersOnly(n)
+// If mobileOnly is set, numbers that can't be mobile numbers are removed as well.
+// The numbers are returned in the order that they first occur in.
+func cleanMSISDNs(ns, cs []string, mobileOnly bool) []string {
+	ms := mapMSISDNs(ns, cs, mobileOnly)
+	pNs := make([]string, len(ms))
+	for i, m := range ms {
+		pNs[i] = m.MSISDN
+	}
+	return pNs
+}
 
-		// remove all spaces
-		n = strings.Replace(n, " ", "", -1)
+// MSISDNInputs is a cleaned number, along with the positions of the numbers in
+// a request that were cleaned to it
+type MSISDNInputs struct {
+	MSISDN string `json:"msisdn"`
+	Inputs []int  `json:"inputs"` // Starting at 0
+}
 
-		// add the country code and verify if number is valid
-		n = addCountryCode(n, cs)
-		if n != "" {
-			pNs = append(pNs, n)
+// mapMSISDNs cleans the numbers in the same way as cleanMSISDNs, and lists the
+// positions of the numbers in ns that each cleaned number occurs at.
+func mapMSISDNs(ns, cs []string, mobileOnly bool) []MSISDNInputs {
+	ms := []MSISDNInputs{}
+	pos := map[string]int{}
+	for i, rn := range resolveAll(ns, cs, mobileOnly) {
+		if rn.reason != "" {
+			continue
+		}
+		n := formatMSISDN(rn.number)
+		if p, ok := pos[n]; ok {
+			ms[p].Inputs = append(ms[p].Inputs, i)
+			continue
 		}
+		pos[n] = len(ms)
+		ms = append(ms, MSISDNInputs{MSISDN: n, Inputs: []int{i}})
 	}
-
-	pNs = removeDuplicates(pNs)
-	return pNs
+	return ms
 }
 
 func numbersOnly(t string) string {
@@ -51,31 +70,206 @@ func numbersOnly(t string) string {
 	return string(cleaned)
 }
 
-// addCountryCode will find the first possible valid number for the
-// given set of country codes.  This function may be a bottleneck
-// for large amounts of mobile numbers. More prevalent country codes
-// must be placed at the top of the country code slice to improve
-// performance.
-func addCountryCode(t string, cs []string) string {
-	mn, _ := libphonenumber.Parse(t, cs[0])
-	if libphonenumber.IsValidNumberForRegion(mn, cs[0]) {
-		t = fmt.Sprintf("%v%v", *mn.CountryCode, *mn.NationalNumber)
-		return t
+// resolveParallelMin is the shortest list of numbers that is resolved on more than one CPU
+const resolveParallelMin = 2000
+
+// resolvedNumber is the outcome of resolving a number
+type resolvedNumber struct {
+	number *libphonenumber.PhoneNumber
+	reason string // Empty if the number is accepted
+}
+
+// resolveAll resolves every number, in the order of ns.  Long lists are
+// spread over the available CPUs, since parsing is relatively slow.
+func resolveAll(ns, cs []string, mobileOnly bool) []resolvedNumber {
+	res := make([]resolvedNumber, len(ns))
+	rv := newNumberResolver(cs, mobileOnly)
+	resolve := func(from, to int) {
+		for i := from; i < to; i++ {
+			res[i].number, res[i].reason = rv.resolve(ns[i])
+		}
 	}
-	if len(cs) > 1 {
-		addCountryCode(t, cs[1:])
+	workers := runtime.NumCPU()
+	if len(ns) < resolveParallelMin || workers < 2 {
+		resolve(0, len(ns))
+		return res
 	}
-	return ""
+
+	var wg sync.WaitGroup
+	size := (len(ns) + workers - 1) / workers
+	for from := 0; from < len(ns); from += size {
+		to := from + size
+		if to > len(ns) {
+			to = len(ns)
+		}
+		wg.Add(1)
+		go func(from, to int) {
+			defer wg.Done()
+			resolve(from, to)
+		}(from, to)
+	}
+	wg.Wait()
+	return res
+}
+
+// numberResolver finds the country of numbers, out of a list of countries.
+// National numbers are tried against each country in the configured order, so
+// a number that is valid in more than one of the countries always belongs to
+// the first of them, whatever numbers come before it in the list.
+type numberResolver struct {
+	countries  []string        // Region codes, e.g. "ZA"
+	allowed    map[string]bool // The region codes in countries
+	mobileOnly bool
 }
 
-func removeDuplicates(ns []string) []string {
-	fnd := map[string]bool{}
-	for v := range ns {
-		fnd[ns[v]] = true
+// newNumberResolver creates a resolver for the countries.  Unknown region codes
+// are ignored.  Without any countries, only numbers in international format are
+// accepted, for any country.
+func newNumberResolver(cs []string, mobileOnly bool) *numberResolver {
+	rv := &numberResolver{allowed: map[string]bool{}, mobileOnly: mobileOnly}
+	for _, c := range cs {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if libphonenumber.GetCountryCodeForRegion(c) == 0 || rv.allowed[c] {
+			continue
+		}
+		rv.allowed[c] = true
+		rv.countries = append(rv.countries, c)
 	}
-	res := []string{}
-	for key := range fnd {
-		res = append(res, key)
+	return rv
+}
+
+// resolve parses a number, and returns the reason that it is rejected, or an
+// empty string if it is accepted.  Numbers starting with + or 00 are in
+// international format, and are accepted for any of the countries.  Other
+// numbers are tried as national numbers of each country in turn.  The parsed
+// number is also returned for numbers that are only valid for other countries.
+func (rv *numberResolver) resolve(t string) (*libphonenumber.PhoneNumber, string) {
+	t = strings.TrimSpace(t)
+	n := numbersOnly(t)
+	if n == "" {
+		return nil, rejectNotNumber
+	}
+
+	if strings.HasPrefix(t, "+") || strings.HasPrefix(n, "00") {
+		pn, err := libphonenumber.Parse("+"+strings.TrimPrefix(n, "00"), "")
+		if err != nil || !libphonenumber.IsValidNumber(pn) {
+			return nil, rejectNotNumber
+		}
+		if len(rv.allowed) != 0 && !rv.allowed[libphonenumber.GetRegionCodeForNumber(pn)] {
+			return pn, rejectWrongRegion
+		}
+		return pn, rv.checkType(pn)
+	}
+
+	for _, c := range rv.countries {
+		pn, err := libphonenumber.Parse(n, c)
+		if err == nil && libphonenumber.IsValidNumberForRegion(pn, c) {
+			return pn, rv.checkType(pn)
+		}
+	}
+	// The number may be in international format without the +
+	if pn, err := libphonenumber.Parse("+"+n, ""); err == nil && libphonenumber.IsValidNumber(pn) {
+		return pn, rejectWrongRegion
+	}
+	return nil, rejectNotNumber
+}
+
+func (rv *numberResolver) checkType(pn *libphonenumber.PhoneNumber) string {
+	if !rv.mobileOnly {
+		return ""
+	}
+	switch libphonenumber.GetNumberType(pn) {
+	case libphonenumber.MOBILE, libphonenumber.FIXED_LINE_OR_MOBILE:
+		return ""
+	}
+	return rejectNotMobile
+}
+
+// formatMSISDN returns a number in the form that it is sent to providers, which
+// is the E.164 format without the +, e.g. 27830000000
+func formatMSISDN(pn *libphonenumber.PhoneNumber) string {
+	return strings.TrimPrefix(libphonenumber.Format(pn, libphonenumber.E164), "+")
+}
+
+// Reasons that a number is rejected
+const (
+	rejectNotNumber   = "notNumber"
+	rejectWrongRegion = "wrongRegion"
+	rejectNotMobile   = "notMobile"
+	rejectDuplicate   = "duplicate"
+)
+
+var numberTypes = map[libphonenumber.PhoneNumberType]string{
+	libphonenumber.FIXED_LINE:           "fixed",
+	libphonenumber.MOBILE:               "mobile",
+	libphonenumber.FIXED_LINE_OR_MOBILE: "fixedOrMobile",
+	libphonenumber.TOLL_FREE:            "tollFree",
+	libphonenumber.PREMIUM_RATE:         "premiumRate",
+	libphonenumber.SHARED_COST:          "sharedCost",
+	libphonenumber.VOIP:                 "voip",
+	libphonenumber.PERSONAL_NUMBER:      "personal",
+	libphonenumber.PAGER:                "pager",
+	libphonenumber.UAN:                  "uan",
+	libphonenumber.VOICEMAIL:            "voicemail",
+	libphonenumber.UNKNOWN:              "unknown",
+}
+
+// NormalizedNumber is the outcome of cleaning a single number
+type NormalizedNumber struct {
+	Index       int    `json:"index"` // Position of the number in the request, starting at 0
+	Input       string `json:"input"`
+	MSISDN      string `json:"msisdn,omitempty"` // The number as it is sent, e.g. 27830000000
+	E164        string `json:"e164,omitempty"`   // e.g. +27830000000
+	Region      string `json:"region,omitempty"` // Detected country, e.g. ZA
+	Type        string `json:"type,omitempty"`   // mobile, fixed, fixedOrMobile, voip, tollFree, ...
+	Valid       bool   `json:"valid"`
+	Reason      string `json:"reason,omitempty"` // notNumber, wrongRegion, notMobile or duplicate
+	Description string `json:"description,omitempty"`
+	DuplicateOf *int   `json:"duplicateOf,omitempty"` // Index of the first occurrence of the number
+}
+
+// normalizeReport cleans every number in the same way as cleanMSISDNs, and
+// describes the outcome of each one.  Numbers that are rejected are still
+// described as far as possible, e.g. the country of a number that is valid but
+// not for one of the given countries.
+func normalizeReport(ns, cs []string, mobileOnly bool) []NormalizedNumber {
+	res := make([]NormalizedNumber, len(ns))
+	fnd := map[string]int{}
+	for i, rn := range resolveAll(ns, cs, mobileOnly) {
+		nn := NormalizedNumber{Index: i, Input: ns[i]}
+		pn, reason := rn.number, rn.reason
+		if pn != nil {
+			describeNumber(&nn, pn)
+		}
+		switch reason {
+		case "":
+			nn.MSISDN = formatMSISDN(pn)
+			if first, ok := fnd[nn.MSISDN]; ok {
+				nn.Reason = rejectDuplicate
+				nn.Description = fmt.Sprintf("Duplicate of input %v", first)
+				nn.DuplicateOf = &first
+			} else {
+				nn.Valid = true
+				fnd[nn.MSISDN] = i
+			}
+		case rejectWrongRegion:
+			nn.Reason = reason
+			nn.Description = "Not a valid number for the configured countries"
+		case rejectNotMobile:
+			nn.Reason = reason
+			nn.Description = "Not a mobile number"
+		default:
+			nn.Reason = reason
+			nn.Description = "Not a valid phone number"
+		}
+		res[i] = nn
 	}
 	return res
 }
+
+// describeNumber sets the international form, country and type of a number
+func describeNumber(nn *NormalizedNumber, pn *libphonenumber.PhoneNumber) {
+	nn.E164 = libphonenumber.Format(pn, libphonenumber.E164)
+	nn.Region = libphonenumber.GetRegionCodeForNumber(pn)
+	nn.Type = numberTypes[libphonenumber.GetNumberType(pn)]
+}
@@ -0,0 +1,125 @@
+package messaging
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCleanMSISDNsCountryOrder(t *testing.T) {
+	// 0811234567 is valid in both countries, and always belongs to the first
+	// configured one, even after a number that is only valid in Namibia
+	cs := []string{"ZA", "NA"}
+	for _, c := range []struct {
+		in   []string
+		want []string
+	}{
+		{[]string{"061234567", "0811234567"}, []string{"26461234567", "27811234567"}},
+		{[]string{"0811234567", "061234567"}, []string{"27811234567", "26461234567"}},
+	} {
+		if got := cleanMSISDNs(c.in, cs, false); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("cleanMSISDNs(%v) = %v, want %v", c.in, got, c.want)
+		}
+	}
+	if got := cleanMSISDNs([]string{"061234567", "0811234567"}, []string{"NA", "ZA"}, false); got[1] != "264811234567" {
+		t.Errorf("Expected 0811234567 to belong to NA when it is configured first, got %v", got[1])
+	}
+}
+
+func TestNormalizeReport(t *testing.T) {
+	// The numbers are normalized together, so that duplicates refer to earlier inputs
+	cases := []struct {
+		input       string
+		msisdn      string
+		valid       bool
+		reason      string
+		duplicateOf int // -1 if not a duplicate
+	}{
+		{"0820000001", "27820000001", true, "", -1},
+		{"+27 82 000 0001", "27820000001", false, rejectDuplicate, 0},
+		{"abc", "", false, rejectNotNumber, -1},
+		{"+264 61 234 567", "", false, rejectWrongRegion, -1},
+		{"0211234567", "", false, rejectNotMobile, -1},
+		{"27820000001", "27820000001", false, rejectDuplicate, 0}, // Always refers to the first occurrence
+		{"0831234567", "27831234567", true, "", -1},
+	}
+	ns := make([]string, len(cases))
+	for i, c := range cases {
+		ns[i] = c.input
+	}
+	res := normalizeReport(ns, []string{"ZA"}, true)
+	if len(res) != len(cases) {
+		t.Fatalf("Expected %v results, got %v", len(cases), len(res))
+	}
+	for i, c := range cases {
+		r := res[i]
+		dup := -1
+		if r.DuplicateOf != nil {
+			dup = *r.DuplicateOf
+		}
+		if r.Index != i || r.Input != c.input || r.MSISDN != c.msisdn || r.Valid != c.valid || r.Reason != c.reason || dup != c.duplicateOf {
+			t.Errorf("normalizeReport(%v) = %+v, duplicate of %v", c.input, r, dup)
+		}
+	}
+}
+
+func TestMapMSISDNs(t *testing.T) {
+	cs := []string{"ZA"}
+	for _, c := range []struct {
+		in   []string
+		want []MSISDNInputs
+	}{
+		{[]string{}, []MSISDNInputs{}},
+		{[]string{"abc"}, []MSISDNInputs{}},
+		{[]string{"0820000001", "0820000002"}, []MSISDNInputs{{"27820000001", []int{0}}, {"27820000002", []int{1}}}},
+		// Invalid numbers keep their positions, and duplicates are listed against the first occurrence
+		{[]string{"abc", "0820000002", "+27 82 000 0001", "27820000002", "0820000001"},
+			[]MSISDNInputs{{"27820000002", []int{1, 3}}, {"27820000001", []int{2, 4}}}},
+	} {
+		if got := mapMSISDNs(c.in, cs, false); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("mapMSISDNs(%v) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestMapMSISDNsParallel(t *testing.T) {
+	// Enough numbers to be resolved on more than one CPU, with every number
+	// repeated later in the list in another form
+	n := resolveParallelMin
+	ns := make([]string, 2*n)
+	for i := 0; i < n; i++ {
+		ns[i] = fmt.Sprintf("082%07d", i)
+		ns[n+i] = fmt.Sprintf("+27 82 %07d", i)
+	}
+	ms := mapMSISDNs(ns, []string{"ZA"}, false)
+	if len(ms) != n {
+		t.Fatalf("Expected %v numbers, got %v", n, len(ms))
+	}
+	for i, m := range ms {
+		want := MSISDNInputs{fmt.Sprintf("2782%07d", i), []int{i, n + i}}
+		if !reflect.DeepEqual(m, want) {
+			t.Fatalf("Expected %v at %v, got %v", want, i, m)
+		}
+	}
+}
+
+func BenchmarkCleanMSISDNs(b *testing.B) {
+	ns := make([]string, 100000)
+	for i := range ns {
+		switch i % 4 {
+		case 0:
+			ns[i] = fmt.Sprintf("082 %03d %04d", i/10000, i%10000)
+		case 1:
+			ns[i] = fmt.Sprintf("+27 83 %07d", i)
+		case 2:
+			ns[i] = fmt.Sprintf("2772%07d", i)
+		case 3:
+			ns[i] = fmt.Sprintf("081%07d", i)
+		}
+	}
+	cs := []string{"ZA", "NA"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cleanMSISDNs(ns, cs, false)
+	}
+}
@@ -0,0 +1,131 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// SenderFactory creates an SMSSender for a configured provider.  The factory
+// receives the provider's entire configuration block, as it appears in the
+// config file, so that providers can define their own settings.
+type SenderFactory func(config json.RawMessage) (SMSSender, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]SenderFactory{}
+)
+
+func init() {
+	RegisterSender("Clickatell", func(config json.RawMessage) (SMSSender, error) {
+		return ClickatellSender{}, nil
+	})
+	RegisterSender("MockProvider", func(config json.RawMessage) (SMSSender, error) {
+		return MockProviderSender{}, nil
+	})
+}
+
+// RegisterSender makes an SMS provider available by the provider name used in
+// the config.  It is intended to be called from the init function of packages
+// that implement their own providers.  RegisterSender panics if it is called
+// twice with the same name, or if the factory is nil.
+func RegisterSender(name string, factory SenderFactory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("messaging: RegisterSender factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("messaging: RegisterSender called twice for provider " + name)
+	}
+	factories[name] = factory
+}
+
+// Senders returns the names of the registered SMS providers, in sorted order.
+func Senders() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	var ns []string
+	for n := range factories {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// senderStarter is implemented by senders that keep a connection to the
+// provider open.  Start is called once, when the sender is created, and must
+// not block.
+type senderStarter interface {
+	Start(s *MessagingServer) error
+}
+
+// receiptPusher is implemented by senders that receive delivery receipts from
+// the provider, so that the status of their messages doesn't need to be polled.
+type receiptPusher interface {
+	PushesReceipts() bool
+}
+
+// senderCache holds the sender of each configured provider, which is created
+// the first time that the provider is used.
+type senderCache struct {
+	mu      sync.Mutex
+	senders map[string]SMSSender
+}
+
+// getSender returns the sender for the provider, creating it from the
+// registered factory if necessary.
+func (s *MessagingServer) getSender(p ConfigSmsProvider) (SMSSender, error) {
+	s.senders.mu.Lock()
+	defer s.senders.mu.Unlock()
+	if sdr, ok := s.senders.senders[p.key()]; ok {
+		return sdr, nil
+	}
+
+	factoriesMu.RLock()
+	f, ok := factories[p.Name]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("SMS provider %v is not registered", p.Name)
+	}
+	sdr, err := f(p.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("SMS provider %v: %v", p.key(), err)
+	}
+	if st, ok := sdr.(senderStarter); ok {
+		if err := st.Start(s); err != nil {
+			return nil, fmt.Errorf("SMS provider %v: %v", p.key(), err)
+		}
+	}
+	if s.senders.senders == nil {
+		s.senders.senders = map[string]SMSSender{}
+	}
+	s.senders.senders[p.key()] = sdr
+	return sdr, nil
+}
+
+// pushesReceipts reports whether the provider pushes delivery receipts, either
+// to a callback or over its own connection.
+func (s *MessagingServer) pushesReceipts(p ConfigSmsProvider) bool {
+	if p.Callback.Enabled {
+		return true
+	}
+	sdr, err := s.getSender(p)
+	if err != nil {
+		return false
+	}
+	rp, ok := sdr.(receiptPusher)
+	return ok && rp.PushesReceipts()
+}
+
+// createSenders creates the senders of all the configured providers, so that
+// configuration errors are reported at startup.
+func (s *MessagingServer) createSenders() error {
+	for _, p := range s.Config.providers() {
+		if _, err := s.getSender(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package messaging
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Defaults for the retry policy, used when a value is not configured
+const (
+	defaultInitialBackoff = "1s"
+	defaultMaxBackoff     = "1m"
+	defaultMultiplier     = 2.0
+)
+
+var defaultRetryableCodes = []string{"429", "500", "502", "503", "504"}
+
+// codedError is implemented by provider errors that carry an error code, such
+// as an HTTP status or a provider specific error number.
+type codedError interface {
+	ErrorCode() string
+}
+
+// sendAttempt records the outcome of one attempt to send a batch to the provider.
+type sendAttempt struct {
+	Attempt     int
+	Time        time.Time
+	ErrorCode   string
+	Description string
+}
+
+// isRetryable reports whether a send error is transient.  Network errors are
+// always retried, while provider errors are only retried if their code is
+// listed as retryable.
+func (r *ConfigRetry) isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	ce, ok := err.(codedError)
+	if !ok {
+		return false
+	}
+	codes := r.RetryableCodes
+	if len(codes) == 0 {
+		codes = defaultRetryableCodes
+	}
+	for _, c := range codes {
+		if c == ce.ErrorCode() {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the time to wait before the next attempt, after the given
+// number of failed attempts.
+func (r *ConfigRetry) backoff(attempt int) time.Duration {
+	initial := parseDurationOrDefault(r.InitialBackoff, defaultInitialBackoff)
+	max := parseDurationOrDefault(r.MaxBackoff, defaultMaxBackoff)
+	mul := r.Multiplier
+	if mul < 1 {
+		mul = defaultMultiplier
+	}
+
+	d := float64(initial) * math.Pow(mul, float64(attempt-1))
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if r.Jitter > 0 {
+		// Spread the delay by up to Jitter in either direction
+		d += d * r.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+func parseDurationOrDefault(s, def string) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil || s == "" {
+		d, _ = time.ParseDuration(def)
+	}
+	return d
+}
+
+// sendWithRetry sends a message through the SMS sender, retrying transient
+// failures according to the provider's retry policy.  Every attempt is returned
+// so that it can be recorded against the batch.  A sender may fail partway
+// through a batch, after some of the recipients were accepted: those recipients
+// are not sent the message again, and only the rest of the batch is retried.
+func sendWithRetry(s *MessagingServer, smsSender SMSSender, m Message) ([]SendSMSResponseMessage, []sendAttempt, error) {
+	policy := m.Provider.Retry
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var attempts []sendAttempt
+	var accepted []SendSMSResponseMessage
+	for a := 1; ; a++ {
+		resp, err := smsSender.SendSMS(s, m)
+		sa := sendAttempt{Attempt: a, Time: time.Now().UTC()}
+		if err != nil {
+			sa.Description = err.Error()
+			if ce, ok := err.(codedError); ok {
+				sa.ErrorCode = ce.ErrorCode()
+			}
+		}
+		attempts = append(attempts, sa)
+
+		if a >= maxAttempts || !policy.isRetryable(err) {
+			return append(accepted, resp...), attempts, err
+		}
+		var rs []SendSMSResponseMessage
+		m.Destination, rs = unsentDestinations(m.Destination, resp)
+		accepted = append(accepted, rs...)
+		if len(m.Destination) == 0 {
+			return accepted, attempts, nil
+		}
+		wait := policy.backoff(a)
+		s.Log.Warnf("Send attempt %v of %v failed, retrying in %v: %v", a, maxAttempts, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// unsentDestinations returns the destinations that were not accepted by the
+// provider, along with the results of the ones that were.
+func unsentDestinations(ns []string, resp []SendSMSResponseMessage) ([]string, []SendSMSResponseMessage) {
+	sent := map[string]bool{}
+	var rs []SendSMSResponseMessage
+	for _, r := range resp {
+		if r.sent() && r.To != "" {
+			sent[r.To] = true
+			rs = append(rs, r)
+		}
+	}
+	var rest []string
+	for _, n := range ns {
+		if !sent[n] {
+			rest = append(rest, n)
+		}
+	}
+	return rest, rs
+}
@@ -0,0 +1,171 @@
+package messaging
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// providerRoute is the set of numbers that are sent the same text through one provider
+type providerRoute struct {
+	Provider ConfigSmsProvider
+	Text     string
+	MSISDNs  []string
+}
+
+// key uniquely identifies a provider.  It is stored with every message, so that
+// the status can later be retrieved from the same provider.
+func (p ConfigSmsProvider) key() string {
+	if p.ID != "" {
+		return p.ID
+	}
+	return p.Name
+}
+
+// batchSize returns the number of messages to send per batch, out of n messages
+func (p ConfigSmsProvider) batchSize(n int) int {
+	if p.MaxBatchSize > 0 {
+		return p.MaxBatchSize
+	}
+	return n
+}
+
+// batchCount returns the number of batches required to send n messages
+func (p ConfigSmsProvider) batchCount(n int) int {
+	bs := p.batchSize(n)
+	if bs <= 0 {
+		return 0
+	}
+	return (n + bs - 1) / bs
+}
+
+// matches reports whether the routing rules of the provider allow sending a
+// message from the originator to the MSISDN.  It returns the specificity of
+// the match, where rules on a country code are more specific than rules on an
+// originator, and a provider without any rules matches with a specificity of 0.
+func (r ConfigRouting) matches(msisdn, originator string) (bool, int) {
+	spec := 0
+	if len(r.CountryCodes) > 0 {
+		fnd := false
+		for _, cc := range r.CountryCodes {
+			if strings.HasPrefix(msisdn, cc) {
+				fnd = true
+				break
+			}
+		}
+		if !fnd {
+			return false, 0
+		}
+		spec += 2
+	}
+	if len(r.Originators) > 0 {
+		fnd := false
+		for _, o := range r.Originators {
+			if strings.EqualFold(o, originator) {
+				fnd = true
+				break
+			}
+		}
+		if !fnd {
+			return false, 0
+		}
+		spec++
+	}
+	return true, spec
+}
+
+func (r ConfigRouting) weight() int {
+	if r.Weight <= 0 {
+		return 1
+	}
+	return r.Weight
+}
+
+// providers returns all of the enabled SMS providers.  The primary provider,
+// configured as 'smsProvider', is always first.
+func (c *Configuration) providers() []ConfigSmsProvider {
+	ps := []ConfigSmsProvider{c.SMSProvider}
+	for _, p := range c.SMSProviders {
+		if p.Enabled {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// provider finds a provider by its key.  Messages that were recorded before a
+// provider was stored against them have an empty key, and belong to the primary provider.
+func (c *Configuration) provider(key string) (ConfigSmsProvider, bool) {
+	if key == "" {
+		return c.SMSProvider, true
+	}
+	for _, p := range c.providers() {
+		if p.key() == key {
+			return p, true
+		}
+	}
+	return ConfigSmsProvider{}, false
+}
+
+// routeProvider selects the provider to send a message to the MSISDN through.
+// Of the providers with the most specific matching rules, one is chosen at
+// random according to their weights.  Numbers that do not match any rules are
+// sent through the primary provider.
+func (c *Configuration) routeProvider(msisdn, originator string, ps []ConfigSmsProvider) ConfigSmsProvider {
+	var cands []ConfigSmsProvider
+	best, total := -1, 0
+	for _, p := range ps {
+		ok, spec := p.Routing.matches(msisdn, originator)
+		if !ok || spec < best {
+			continue
+		}
+		if spec > best {
+			best, total, cands = spec, 0, nil
+		}
+		cands = append(cands, p)
+		total += p.Routing.weight()
+	}
+	if len(cands) == 0 {
+		return c.SMSProvider
+	}
+
+	w := rand.Intn(total)
+	for _, p := range cands {
+		w -= p.Routing.weight()
+		if w < 0 {
+			return p
+		}
+	}
+	return cands[len(cands)-1]
+}
+
+// routeNumbers groups the numbers by the provider they must be sent through.
+// The routes are returned in the order in which each provider was first selected.
+func (s *MessagingServer) routeNumbers(originator string, ns []string) []providerRoute {
+	rms := make([]RecipientMessage, len(ns))
+	for i, n := range ns {
+		rms[i].MSISDN = n
+	}
+	return s.routeMessages(originator, rms)
+}
+
+// routeMessages groups the messages by the provider they must be sent through,
+// and by their text, since a batch can only contain a single text.  The routes
+// are returned in the order in which each combination was first seen.
+func (s *MessagingServer) routeMessages(originator string, rms []RecipientMessage) []providerRoute {
+	type routeKey struct{ provider, text string }
+	ps := s.Config.providers()
+	idx := map[routeKey]int{}
+	var routes []providerRoute
+	for _, rm := range rms {
+		p := s.Config.routeProvider(rm.MSISDN, originator, ps)
+		k := routeKey{p.key(), rm.Text}
+		i, ok := idx[k]
+		if !ok {
+			i = len(routes)
+			idx[k] = i
+			routes = append(routes, providerRoute{Provider: p, Text: rm.Text})
+		}
+		routes[i].MSISDNs = append(routes[i].MSISDNs, rm.MSISDN)
+	}
+	return routes
+}
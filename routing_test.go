@@ -0,0 +1,72 @@
+package messaging
+
+import (
+	"testing"
+)
+
+func TestRouteNumbersPrecedence(t *testing.T) {
+	s := testServer()
+	s.Config.SMSProvider = ConfigSmsProvider{Name: "Primary"}
+	s.Config.SMSProviders = []ConfigSmsProvider{
+		{Name: "Country", Enabled: true, Routing: ConfigRouting{CountryCodes: []string{"264"}}},
+		{Name: "Originator", Enabled: true, Routing: ConfigRouting{Originators: []string{"alerts@imqs.co.za"}}},
+		{Name: "Both", Enabled: true, Routing: ConfigRouting{CountryCodes: []string{"267"}, Originators: []string{"alerts@imqs.co.za"}}},
+		{Name: "Disabled", Enabled: false, Routing: ConfigRouting{CountryCodes: []string{"27"}}},
+	}
+	for _, c := range []struct {
+		originator string
+		msisdn     string
+		want       string
+	}{
+		{"test@imqs.co.za", "27820000001", "Primary"},  // No rules match, and disabled providers are ignored
+		{"test@imqs.co.za", "264810000001", "Country"}, // Country rules match any originator
+		{"ALERTS@imqs.co.za", "27820000001", "Originator"},
+		{"alerts@imqs.co.za", "264810000001", "Country"}, // A country is more specific than an originator
+		{"alerts@imqs.co.za", "26771000001", "Both"},     // Both rules are more specific than either
+		{"test@imqs.co.za", "26771000001", "Primary"},    // Every rule of a provider must match
+	} {
+		rts := s.routeNumbers(c.originator, []string{c.msisdn})
+		if len(rts) != 1 || rts[0].Provider.key() != c.want {
+			t.Errorf("routeNumbers(%v, %v) = %+v, want %v", c.originator, c.msisdn, rts, c.want)
+		}
+	}
+}
+
+func TestRouteNumbersGrouping(t *testing.T) {
+	s := testServer()
+	s.Config.SMSProvider = ConfigSmsProvider{Name: "Primary"}
+	s.Config.SMSProviders = []ConfigSmsProvider{
+		{Name: "Country", Enabled: true, Routing: ConfigRouting{CountryCodes: []string{"264"}}},
+	}
+	rts := s.routeNumbers("", []string{"264810000001", "27820000001", "264810000002"})
+	if len(rts) != 2 {
+		t.Fatalf("Expected 2 routes, got %+v", rts)
+	}
+	// Routes are in the order in which their provider was first selected
+	if rts[0].Provider.key() != "Country" || len(rts[0].MSISDNs) != 2 || rts[0].MSISDNs[1] != "264810000002" {
+		t.Errorf("Unexpected first route %+v", rts[0])
+	}
+	if rts[1].Provider.key() != "Primary" || len(rts[1].MSISDNs) != 1 {
+		t.Errorf("Unexpected second route %+v", rts[1])
+	}
+}
+
+func TestRouteNumbersWeights(t *testing.T) {
+	s := testServer()
+	s.Config.SMSProvider = ConfigSmsProvider{Name: "Primary", Routing: ConfigRouting{CountryCodes: []string{"27"}, Weight: 3}}
+	s.Config.SMSProviders = []ConfigSmsProvider{
+		{Name: "Secondary", Enabled: true, Routing: ConfigRouting{CountryCodes: []string{"27"}}}, // Defaults to a weight of 1
+	}
+	ns := make([]string, 4000)
+	for i := range ns {
+		ns[i] = "27820000001"
+	}
+	counts := map[string]int{}
+	for _, rt := range s.routeNumbers("", ns) {
+		counts[rt.Provider.key()] += len(rt.MSISDNs)
+	}
+	// Expect 3000 and 1000, with a wide margin so that the test doesn't fail by chance
+	if counts["Primary"] < 2700 || counts["Secondary"] < 700 || counts["Primary"]+counts["Secondary"] != len(ns) {
+		t.Errorf("Expected numbers to be split 3:1, got %v", counts)
+	}
+}
@@ -0,0 +1,153 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Scheduled send states
+const (
+	schedulePending   = "pending"
+	scheduleSent      = "sent"
+	scheduleFailed    = "failed"
+	scheduleCancelled = "cancelled"
+)
+
+const (
+	defaultScheduleInterval          = "1m"
+	defaultScheduleProcessingTimeout = "10m"
+)
+
+// Layouts accepted for sendAt when it does not include a UTC offset
+var sendAtLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// ScheduledSend is a send request that is held back until its delivery time.
+// The messages are rendered when the send is scheduled, so any errors are
+// reported immediately, and changes to a template afterwards have no effect.
+type ScheduledSend struct {
+	ID                string    `json:"id"`
+	SendAt            time.Time `json:"sendAt"`
+	TimeZone          string    `json:"timeZone"`
+	Status            string    `json:"status"`
+	StatusDescription string    `json:"statusDescription"`
+	Priority          string    `json:"priority"`
+	Originator        string    `json:"originator"`
+	Message           string    `json:"message"`
+	Template          string    `json:"template,omitempty"`
+	TemplateVersion   int       `json:"templateVersion,omitempty"`
+	Recipients        int       `json:"recipients"`
+	RefNumber         string    `json:"refNumber,omitempty"` // The campaign, once the messages have been sent
+	CreatedTime       time.Time `json:"createdTime"`
+
+	messages []RecipientMessage
+}
+
+// parseSendAt reads a delivery time.  A time with a UTC offset is used as is.
+// Otherwise it is read as a local time in the time zone, which defaults to UTC.
+// It returns the time in UTC, and the name of the time zone.
+func parseSendAt(sendAt, timeZone string) (time.Time, string, error) {
+	if timeZone == "" {
+		timeZone = "UTC"
+	}
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("Unknown time zone %v", timeZone)
+	}
+	if t, err := time.Parse(time.RFC3339, sendAt); err == nil {
+		return t.UTC(), timeZone, nil
+	}
+	for _, l := range sendAtLayouts {
+		if t, err := time.ParseInLocation(l, sendAt, loc); err == nil {
+			return t.UTC(), timeZone, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("Invalid sendAt time %v", sendAt)
+}
+
+// ScheduleSMS stores rendered messages to be sent at the given time, which must
+// be in the future.
+func (s *MessagingServer) ScheduleSMS(t Template, eml string, rms []RecipientMessage, sendAt time.Time, timeZone, priority string) (ScheduledSend, error) {
+	if !sendAt.After(time.Now()) {
+		return ScheduledSend{}, errors.New("sendAt must be in the future")
+	}
+	ss := ScheduledSend{
+		SendAt:          sendAt,
+		TimeZone:        timeZone,
+		Status:          schedulePending,
+		Priority:        priority,
+		Originator:      eml,
+		Message:         t.Body,
+		Template:        t.Name,
+		TemplateVersion: t.Version,
+		Recipients:      len(rms),
+		CreatedTime:     time.Now().UTC(),
+		messages:        rms,
+	}
+	var err error
+	if ss.ID, err = s.DB.createSchedule(ss); err != nil {
+		s.Log.Errorf("Could not schedule messages: %v", err)
+		return ss, errors.New("ScheduleSMS DB error")
+	}
+	s.Log.Infof("User %v scheduled message '%v' to %v recipients at %v", eml, t.Body, len(rms), sendAt)
+	return ss, nil
+}
+
+// RescheduleSMS changes the delivery time of a pending scheduled send.  Unless
+// its priority is urgent or emergency, the send can't be moved to a time that
+// is outside the send window of any of its recipients.
+func (s *MessagingServer) RescheduleSMS(id string, sendAt time.Time, timeZone string) (ScheduledSend, error) {
+	if !sendAt.After(time.Now()) {
+		return ScheduledSend{}, errors.New("sendAt must be in the future")
+	}
+	ss, err := s.DB.getSchedule(id)
+	if err != nil {
+		return ss, err
+	}
+	if ss.Priority != PriorityUrgent && ss.Priority != PriorityEmergency && len(s.windows) > 0 {
+		rms, err := s.DB.getScheduleMessages(id)
+		if err != nil {
+			return ScheduledSend{}, err
+		}
+		if err := s.checkSendWindows(rms, sendAt); err != nil {
+			return ScheduledSend{}, err
+		}
+	}
+	if err := s.DB.reschedule(id, sendAt, timeZone); err != nil {
+		return ScheduledSend{}, err
+	}
+	return s.DB.getSchedule(id)
+}
+
+// sendDueSchedules sends every scheduled send whose time has come.  It is run
+// by the IntervalService.
+func (s *MessagingServer) sendDueSchedules() {
+	for {
+		ss, err := s.DB.claimDueSchedule(time.Now().UTC())
+		if err != nil {
+			s.Log.Errorf("Could not retrieve scheduled sends: %v", err)
+			return
+		}
+		if ss == nil {
+			return
+		}
+
+		s.Log.Infof("Sending scheduled send %v to %v recipients", ss.ID, ss.Recipients)
+		// Recipients may have opted out since the send was scheduled
+		rms, suppressed, err := s.filterSuppressed(ss.messages, ss.Priority)
+		var res SendResult
+		if err == nil && len(rms) > 0 {
+			t := Template{Name: ss.Template, Version: ss.TemplateVersion, Body: ss.Message}
+			res, err = s.sendRendered(t, ss.Originator, rms)
+		}
+		st, stDesc := scheduleSent, ""
+		if err != nil {
+			st, stDesc = scheduleFailed, err.Error()
+		} else if suppressed > 0 {
+			stDesc = fmt.Sprintf("%v suppressed numbers were not sent the message", suppressed)
+		}
+		if err := s.DB.completeSchedule(ss.ID, st, stDesc, res.CampaignID); err != nil {
+			s.Log.Errorf("Could not update scheduled send %v: %v", ss.ID, err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package smpp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultEnquireLink = 30 * time.Second
+	defaultTimeout     = 10 * time.Second
+	maxReconnectDelay  = time.Minute
+	deliverQueueLength = 100 // deliver_sm operations waiting for OnDeliver, before reading from the SMSC blocks
+)
+
+// ErrNotBound is returned when a message is submitted while the client is not
+// bound to the SMSC.  It is a temporary error, since the client keeps trying to
+// bind in the background.
+var ErrNotBound error = &notBoundError{}
+
+type notBoundError struct{}
+
+func (e *notBoundError) Error() string   { return "smpp: not bound to SMSC" }
+func (e *notBoundError) Timeout() bool   { return false }
+func (e *notBoundError) Temporary() bool { return true }
+
+// Client maintains a transceiver bind to an SMSC.  The bind is kept alive with
+// enquire_link requests, and re-established whenever the connection is lost.
+// Deliver_sm operations, such as delivery receipts, are passed to OnDeliver in
+// the order they are received, on a goroutine of their own so that a slow
+// handler doesn't hold up the responses to other requests.  A deliver_sm is
+// only acknowledged once OnDeliver returns, and if it returns an error the
+// SMSC is asked to deliver it again later.
+type Client struct {
+	Addr        string
+	Bind        Bind
+	EnquireLink time.Duration               // Interval between enquire_link requests
+	Timeout     time.Duration               // Time to wait for a response from the SMSC
+	OnDeliver   func(m *ShortMessage) error // Called for every deliver_sm received
+	OnError     func(err error)             // Called when the bind fails or is lost
+
+	mu      sync.Mutex
+	conn    net.Conn
+	bound   chan struct{} // Closed while the client is bound
+	seq     uint32
+	pending map[uint32]chan *PDU
+	quit    chan struct{}
+	wmu     sync.Mutex
+}
+
+// Start binds to the SMSC in the background
+func (c *Client) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.quit != nil {
+		return
+	}
+	if c.EnquireLink <= 0 {
+		c.EnquireLink = defaultEnquireLink
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+	c.quit = make(chan struct{})
+	c.bound = make(chan struct{})
+	go c.run(c.quit)
+}
+
+// Close unbinds from the SMSC and stops reconnecting
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.quit == nil {
+		c.mu.Unlock()
+		return nil
+	}
+	close(c.quit)
+	c.quit = nil
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		c.request(Unbind, nil)
+		conn.Close()
+	}
+	return nil
+}
+
+// WaitBound waits until the client is bound, for at most d.  It reports
+// whether the client is bound.
+func (c *Client) WaitBound(d time.Duration) bool {
+	c.mu.Lock()
+	b := c.bound
+	c.mu.Unlock()
+	if b == nil {
+		return false
+	}
+	select {
+	case <-b:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// Submit sends a submit_sm operation and returns the message ID assigned by the SMSC
+func (c *Client) Submit(m *ShortMessage) (string, error) {
+	resp, err := c.request(SubmitSM, m.Body())
+	if err != nil {
+		return "", err
+	}
+	id, _ := readCString(bytes.NewBuffer(resp.Body))
+	return id, nil
+}
+
+// run keeps the client bound until quit is closed
+func (c *Client) run(quit chan struct{}) {
+	delay := time.Second
+	for {
+		err := c.connect()
+		if err == nil {
+			delay = time.Second
+			err = c.serve()
+		}
+		if c.OnError != nil {
+			select {
+			case <-quit:
+			default:
+				c.OnError(err)
+			}
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// connect dials the SMSC and binds as a transceiver
+func (c *Client) connect() error {
+	conn, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return err
+	}
+
+	// The bind response is read directly, before the connection is served
+	p := &PDU{CommandID: BindTransceiver, SequenceNumber: c.nextSeq(), Body: c.Bind.body()}
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	if _, err := conn.Write(p.Bytes()); err != nil {
+		conn.Close()
+		return err
+	}
+	resp, err := ReadPDU(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	if resp.CommandID != BindTransceiverResp || resp.CommandStatus != StatusOK {
+		conn.Close()
+		return &StatusError{CommandID: BindTransceiver, Status: resp.CommandStatus}
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.pending = map[uint32]chan *PDU{}
+	close(c.bound)
+	c.mu.Unlock()
+	return nil
+}
+
+// serve reads PDUs until the connection fails, while sending enquire_link
+// requests in the background.
+func (c *Client) serve() error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		t := time.NewTicker(c.EnquireLink)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if _, err := c.request(EnquireLink, nil); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	delivers := make(chan *PDU, deliverQueueLength)
+	defer close(delivers)
+	go c.deliver(delivers)
+
+	var err error
+	for {
+		var p *PDU
+		if p, err = ReadPDU(conn); err != nil {
+			break
+		}
+		if p.CommandID&GenericNack != 0 {
+			// All responses, including generic_nack, are matched to their request by sequence number
+			c.mu.Lock()
+			ch := c.pending[p.SequenceNumber]
+			delete(c.pending, p.SequenceNumber)
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- p
+			}
+			continue
+		}
+		switch p.CommandID {
+		case DeliverSM:
+			delivers <- p
+		case EnquireLink:
+			c.respond(p.SequenceNumber, EnquireLinkResp, StatusOK, nil)
+		case Unbind:
+			c.respond(p.SequenceNumber, UnbindResp, StatusOK, nil)
+			err = errors.New("smpp: SMSC unbound")
+		default:
+			c.respond(p.SequenceNumber, GenericNack, StatusInvalidCmd, nil)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Fail all requests that are waiting for a response
+	c.mu.Lock()
+	conn.Close()
+	c.conn = nil
+	c.bound = make(chan struct{})
+	for _, ch := range c.pending {
+		close(ch)
+	}
+	c.pending = nil
+	c.mu.Unlock()
+	return err
+}
+
+// deliver passes deliver_sm operations to OnDeliver until ps is closed, and
+// responds to each one with the outcome.  Operations that are still queued when
+// the connection is lost can't be acknowledged, so the SMSC delivers them again.
+func (c *Client) deliver(ps chan *PDU) {
+	for p := range ps {
+		status := StatusOK
+		m, err := ParseShortMessage(p.Body)
+		if err != nil {
+			status = StatusRxPAppn
+		} else if c.OnDeliver != nil {
+			if err := c.OnDeliver(m); err != nil {
+				status = StatusRxTAppn
+			}
+		}
+		c.respond(p.SequenceNumber, DeliverSMResp, status, []byte{0})
+	}
+}
+
+// nextSeq returns the next sequence number, which must be between 1 and 0x7FFFFFFF
+func (c *Client) nextSeq() uint32 {
+	for {
+		if s := atomic.AddUint32(&c.seq, 1) & 0x7FFFFFFF; s != 0 {
+			return s
+		}
+	}
+}
+
+func (c *Client) write(p *PDU) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrNotBound
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	_, err := conn.Write(p.Bytes())
+	return err
+}
+
+func (c *Client) respond(seq, id, status uint32, body []byte) {
+	c.write(&PDU{CommandID: id, CommandStatus: status, SequenceNumber: seq, Body: body})
+}
+
+// request sends a PDU and waits for its response
+func (c *Client) request(id uint32, body []byte) (*PDU, error) {
+	c.mu.Lock()
+	if c.conn == nil {
+		c.mu.Unlock()
+		return nil, ErrNotBound
+	}
+	seq := c.nextSeq()
+	ch := make(chan *PDU, 1)
+	c.pending[seq] = ch
+	c.mu.Unlock()
+
+	if err := c.write(&PDU{CommandID: id, SequenceNumber: seq, Body: body}); err != nil {
+		c.forget(seq)
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, ErrNotBound
+		}
+		if resp.CommandStatus != StatusOK {
+			return resp, &StatusError{CommandID: id, Status: resp.CommandStatus}
+		}
+		return resp, nil
+	case <-time.After(c.Timeout):
+		c.forget(seq)
+		return nil, &timeoutError{}
+	}
+}
+
+func (c *Client) forget(seq uint32) {
+	c.mu.Lock()
+	if c.pending != nil {
+		delete(c.pending, seq)
+	}
+	c.mu.Unlock()
+}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "smpp: timed out waiting for response" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
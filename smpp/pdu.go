@@ -0,0 +1,242 @@
+package smpp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Command IDs of the SMPP v3.4 operations that are supported
+const (
+	GenericNack         uint32 = 0x80000000
+	BindTransceiver     uint32 = 0x00000009
+	BindTransceiverResp uint32 = 0x80000009
+	SubmitSM            uint32 = 0x00000004
+	SubmitSMResp        uint32 = 0x80000004
+	DeliverSM           uint32 = 0x00000005
+	DeliverSMResp       uint32 = 0x80000005
+	Unbind              uint32 = 0x00000006
+	UnbindResp          uint32 = 0x80000006
+	EnquireLink         uint32 = 0x00000015
+	EnquireLinkResp     uint32 = 0x80000015
+)
+
+// Command statuses
+const (
+	StatusOK          uint32 = 0x00000000
+	StatusInvalidCmd  uint32 = 0x00000003
+	StatusBindFail    uint32 = 0x0000000D
+	StatusThrottled   uint32 = 0x00000058
+	StatusSysErr      uint32 = 0x00000008
+	StatusInvalidDest uint32 = 0x0000000B
+	StatusRxTAppn     uint32 = 0x00000064 // ESME_RX_T_APPN: the ESME can't handle the deliver_sm now, and it should be delivered again
+	StatusRxPAppn     uint32 = 0x00000065 // ESME_RX_P_APPN: the ESME rejects the deliver_sm permanently
+)
+
+// Values of the esm_class and data_coding fields
+const (
+	EsmClassUDHI          byte = 0x40 // short_message starts with a user data header
+	EsmClassReceipt       byte = 0x04 // deliver_sm contains an SMSC delivery receipt
+	DataCodingDefault     byte = 0x00 // SMSC default alphabet
+	DataCodingUCS2        byte = 0x08
+	InterfaceVersion      byte = 0x34
+	headerLength               = 16
+	maxPDULength               = 64 * 1024
+	RegisteredDeliveryAll byte = 0x01 // Request a receipt for both successful and failed delivery
+)
+
+// PDU is a single SMPP protocol data unit
+type PDU struct {
+	CommandID      uint32
+	CommandStatus  uint32
+	SequenceNumber uint32
+	Body           []byte
+}
+
+// StatusError is returned when the SMSC responds with a command status other than StatusOK
+type StatusError struct {
+	CommandID uint32
+	Status    uint32
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("smpp: command 0x%08x failed with status 0x%08x", e.CommandID, e.Status)
+}
+
+// ErrorCode returns the command status as a decimal string
+func (e *StatusError) ErrorCode() string {
+	return fmt.Sprintf("%d", e.Status)
+}
+
+// ReadPDU reads the next PDU from the connection
+func ReadPDU(r io.Reader) (*PDU, error) {
+	var hdr [headerLength]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	l := binary.BigEndian.Uint32(hdr[0:4])
+	if l < headerLength || l > maxPDULength {
+		return nil, fmt.Errorf("smpp: invalid PDU length %v", l)
+	}
+	p := &PDU{
+		CommandID:      binary.BigEndian.Uint32(hdr[4:8]),
+		CommandStatus:  binary.BigEndian.Uint32(hdr[8:12]),
+		SequenceNumber: binary.BigEndian.Uint32(hdr[12:16]),
+		Body:           make([]byte, l-headerLength),
+	}
+	if _, err := io.ReadFull(r, p.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Bytes encodes the PDU, including its header
+func (p *PDU) Bytes() []byte {
+	b := make([]byte, headerLength+len(p.Body))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.BigEndian.PutUint32(b[4:8], p.CommandID)
+	binary.BigEndian.PutUint32(b[8:12], p.CommandStatus)
+	binary.BigEndian.PutUint32(b[12:16], p.SequenceNumber)
+	copy(b[headerLength:], p.Body)
+	return b
+}
+
+// Bind contains the fields of a bind_transceiver request
+type Bind struct {
+	SystemID   string
+	Password   string
+	SystemType string
+}
+
+func (b *Bind) body() []byte {
+	var w bytes.Buffer
+	writeCString(&w, b.SystemID)
+	writeCString(&w, b.Password)
+	writeCString(&w, b.SystemType)
+	w.WriteByte(InterfaceVersion)
+	w.WriteByte(0) // addr_ton
+	w.WriteByte(0) // addr_npi
+	writeCString(&w, "")
+	return w.Bytes()
+}
+
+func parseBind(body []byte) (*Bind, error) {
+	r := bytes.NewBuffer(body)
+	b := &Bind{}
+	var err error
+	if b.SystemID, err = readCString(r); err != nil {
+		return nil, err
+	}
+	if b.Password, err = readCString(r); err != nil {
+		return nil, err
+	}
+	if b.SystemType, err = readCString(r); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ShortMessage contains the fields of a submit_sm or deliver_sm operation,
+// which share the same layout.
+type ShortMessage struct {
+	ServiceType        string
+	SourceTON          byte
+	SourceNPI          byte
+	SourceAddr         string
+	DestTON            byte
+	DestNPI            byte
+	DestAddr           string
+	EsmClass           byte
+	ProtocolID         byte
+	PriorityFlag       byte
+	ScheduleDelivery   string
+	ValidityPeriod     string
+	RegisteredDelivery byte
+	ReplaceIfPresent   byte
+	DataCoding         byte
+	DefaultMsgID       byte
+	Message            []byte
+}
+
+// Body encodes the mandatory fields of the operation
+func (m *ShortMessage) Body() []byte {
+	var w bytes.Buffer
+	writeCString(&w, m.ServiceType)
+	w.WriteByte(m.SourceTON)
+	w.WriteByte(m.SourceNPI)
+	writeCString(&w, m.SourceAddr)
+	w.WriteByte(m.DestTON)
+	w.WriteByte(m.DestNPI)
+	writeCString(&w, m.DestAddr)
+	w.WriteByte(m.EsmClass)
+	w.WriteByte(m.ProtocolID)
+	w.WriteByte(m.PriorityFlag)
+	writeCString(&w, m.ScheduleDelivery)
+	writeCString(&w, m.ValidityPeriod)
+	w.WriteByte(m.RegisteredDelivery)
+	w.WriteByte(m.ReplaceIfPresent)
+	w.WriteByte(m.DataCoding)
+	w.WriteByte(m.DefaultMsgID)
+	w.WriteByte(byte(len(m.Message)))
+	w.Write(m.Message)
+	return w.Bytes()
+}
+
+// ParseShortMessage decodes the mandatory fields of a submit_sm or deliver_sm
+// operation.  Optional TLV parameters are ignored.
+func ParseShortMessage(body []byte) (*ShortMessage, error) {
+	r := bytes.NewBuffer(body)
+	m := &ShortMessage{}
+	var err error
+	str := func(s *string) {
+		if err == nil {
+			*s, err = readCString(r)
+		}
+	}
+	byt := func(b *byte) {
+		if err == nil {
+			*b, err = r.ReadByte()
+		}
+	}
+	str(&m.ServiceType)
+	byt(&m.SourceTON)
+	byt(&m.SourceNPI)
+	str(&m.SourceAddr)
+	byt(&m.DestTON)
+	byt(&m.DestNPI)
+	str(&m.DestAddr)
+	byt(&m.EsmClass)
+	byt(&m.ProtocolID)
+	byt(&m.PriorityFlag)
+	str(&m.ScheduleDelivery)
+	str(&m.ValidityPeriod)
+	byt(&m.RegisteredDelivery)
+	byt(&m.ReplaceIfPresent)
+	byt(&m.DataCoding)
+	byt(&m.DefaultMsgID)
+	var l byte
+	byt(&l)
+	if err != nil {
+		return nil, errors.New("smpp: short message is truncated")
+	}
+	if int(l) > r.Len() {
+		return nil, errors.New("smpp: short message is truncated")
+	}
+	m.Message = append([]byte(nil), r.Next(int(l))...)
+	return m, nil
+}
+
+func writeCString(w *bytes.Buffer, s string) {
+	w.WriteString(s)
+	w.WriteByte(0)
+}
+
+func readCString(r *bytes.Buffer) (string, error) {
+	s, err := r.ReadString(0)
+	if err != nil {
+		return "", errors.New("smpp: C-octet string is not terminated")
+	}
+	return s[:len(s)-1], nil
+}
@@ -0,0 +1,87 @@
+package smpp
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Receipt is an SMSC delivery receipt, as contained in the short_message of a
+// deliver_sm operation.  The format is not part of the SMPP specification, but
+// almost all SMSCs use the format in its Appendix B:
+//
+//	id:IIIIIIIIII sub:SSS dlvrd:DDD submit date:YYMMDDhhmm done date:YYMMDDhhmm stat:DDDDDDD err:E text: . . .
+type Receipt struct {
+	ID         string
+	Submitted  string
+	Delivered  string
+	SubmitDate time.Time
+	DoneDate   time.Time
+	Stat       string // DELIVRD, EXPIRED, DELETED, UNDELIV, ACCEPTD, UNKNOWN, REJECTD or ENROUTE
+	Err        string
+	Text       string
+}
+
+// Receipt states
+const (
+	StatDelivered     = "DELIVRD"
+	StatExpired       = "EXPIRED"
+	StatDeleted       = "DELETED"
+	StatUndeliverable = "UNDELIV"
+	StatAccepted      = "ACCEPTD"
+	StatUnknown       = "UNKNOWN"
+	StatRejected      = "REJECTD"
+	StatEnroute       = "ENROUTE"
+)
+
+const receiptDateFormat = "0601021504"
+
+var (
+	receiptField = regexp.MustCompile(`(?i)(id|sub|dlvrd|submit date|done date|stat|err):(\S*)`)
+	receiptText  = regexp.MustCompile(`(?is)text:(.*)$`)
+)
+
+// ParseReceipt reads a delivery receipt from the text of a deliver_sm
+func ParseReceipt(text string) (*Receipt, error) {
+	r := &Receipt{}
+	head := text
+	if loc := receiptText.FindStringSubmatchIndex(text); loc != nil {
+		r.Text = text[loc[2]:loc[3]]
+		head = text[:loc[0]]
+	}
+	for _, f := range receiptField.FindAllStringSubmatch(head, -1) {
+		switch strings.ToLower(f[1]) {
+		case "id":
+			r.ID = f[2]
+		case "sub":
+			r.Submitted = f[2]
+		case "dlvrd":
+			r.Delivered = f[2]
+		case "submit date":
+			r.SubmitDate, _ = time.Parse(receiptDateFormat, f[2])
+		case "done date":
+			r.DoneDate, _ = time.Parse(receiptDateFormat, f[2])
+		case "stat":
+			r.Stat = f[2]
+		case "err":
+			r.Err = f[2]
+		}
+	}
+	if r.ID == "" || r.Stat == "" {
+		return nil, errors.New("smpp: not a delivery receipt")
+	}
+	return r, nil
+}
+
+// Format writes the receipt in the format of Appendix B of the SMPP specification
+func (r *Receipt) Format() string {
+	text := r.Text
+	if len(text) > 20 {
+		text = text[:20]
+	}
+	return "id:" + r.ID + " sub:" + r.Submitted + " dlvrd:" + r.Delivered +
+		" submit date:" + r.SubmitDate.Format(receiptDateFormat) +
+		" done date:" + r.DoneDate.Format(receiptDateFormat) +
+		" stat:" + r.Stat + " err:" + r.Err + " text:" + text
+}
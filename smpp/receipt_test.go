@@ -0,0 +1,13 @@
+package smpp
+
+import "testing"
+
+func TestParseReceipt(t *testing.T) {
+	r, err := ParseReceipt("ID:7A3F sub:001 DLVRD:001 Submit Date:2401021504 done date:2401021505 STAT:DELIVRD err:000 Text:Water supply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != "7A3F" || r.Delivered != "001" || r.Stat != StatDelivered || r.Text != "Water supply" || r.SubmitDate.IsZero() {
+		t.Errorf("Unexpected receipt %+v", r)
+	}
+}
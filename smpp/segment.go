@@ -0,0 +1,58 @@
+package smpp
+
+// Split divides an encoded message into the parts of a concatenated message.
+// A message that fits into single bytes is returned as is.  Otherwise each part
+// is at most part bytes long, and is prefixed with a user data header that
+// identifies the part by the reference number ref.  Such parts must be sent
+// with EsmClassUDHI.
+func Split(msg []byte, single, part int, ref byte) [][]byte {
+	if len(msg) <= single {
+		return [][]byte{msg}
+	}
+
+	var chunks [][]byte
+	for len(msg) > 0 {
+		n := part
+		if n > len(msg) {
+			n = len(msg)
+		}
+		chunks = append(chunks, msg[:n])
+		msg = msg[n:]
+	}
+	return addUDH(chunks, ref)
+}
+
+// SplitAt is like Split, but only splits the message at the byte offsets for
+// which canSplit returns true.  This is used to avoid splitting a character that
+// is encoded as more than one byte across two parts.
+func SplitAt(msg []byte, single, part int, ref byte, canSplit func(i int) bool) [][]byte {
+	if len(msg) <= single {
+		return [][]byte{msg}
+	}
+
+	var chunks [][]byte
+	start := 0
+	for start < len(msg) {
+		end := start + part
+		if end >= len(msg) {
+			end = len(msg)
+		} else {
+			for end > start+1 && !canSplit(end) {
+				end--
+			}
+		}
+		chunks = append(chunks, msg[start:end])
+		start = end
+	}
+	return addUDH(chunks, ref)
+}
+
+func addUDH(chunks [][]byte, ref byte) [][]byte {
+	parts := make([][]byte, len(chunks))
+	for i, c := range chunks {
+		// IEI 0x00: concatenated short message with an 8-bit reference number
+		udh := []byte{0x05, 0x00, 0x03, ref, byte(len(chunks)), byte(i + 1)}
+		parts[i] = append(udh, c...)
+	}
+	return parts
+}
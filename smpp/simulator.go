@@ -0,0 +1,165 @@
+package smpp
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Simulator is a minimal in-process SMSC, for testing SMPP clients without an
+// operator bind.  It accepts transceiver binds, answers enquire_link requests,
+// assigns message IDs to submitted messages, and sends a delivery receipt for
+// every message that requests one.
+type Simulator struct {
+	Bind         Bind          // Credentials to accept. Any credentials are accepted if SystemID is empty
+	ReceiptDelay time.Duration // Time before the delivery receipt of a message is sent
+	ReceiptStat  string        // Status reported in delivery receipts. Defaults to StatDelivered
+
+	ln        net.Listener
+	mu        sync.Mutex
+	nextID    int
+	submitted []ShortMessage
+	receipts  []uint32 // Command status of each deliver_sm_resp
+	conns     map[net.Conn]bool
+}
+
+// NewSimulator starts a simulator listening on a random local port
+func NewSimulator() (*Simulator, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Simulator{ln: ln, conns: map[net.Conn]bool{}}
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the address that the simulator is listening on
+func (s *Simulator) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Submitted returns a copy of every message that has been submitted
+func (s *Simulator) Submitted() []ShortMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ShortMessage(nil), s.submitted...)
+}
+
+// ReceiptResponses returns the command status that the client responded to each
+// delivery receipt with, in the order that the responses were received
+func (s *Simulator) ReceiptResponses() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint32(nil), s.receipts...)
+}
+
+// Close stops listening and drops all connections
+func (s *Simulator) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	return err
+}
+
+func (s *Simulator) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+func (s *Simulator) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	var wmu sync.Mutex
+	var seq uint32
+	send := func(p *PDU) {
+		wmu.Lock()
+		defer wmu.Unlock()
+		conn.Write(p.Bytes())
+	}
+
+	bound := false
+	for {
+		p, err := ReadPDU(conn)
+		if err != nil {
+			return
+		}
+		switch p.CommandID {
+		case BindTransceiver:
+			status := StatusOK
+			if b, err := parseBind(p.Body); err != nil || (s.Bind.SystemID != "" && *b != s.Bind) {
+				status = StatusBindFail
+			}
+			bound = status == StatusOK
+			send(&PDU{CommandID: BindTransceiverResp, CommandStatus: status, SequenceNumber: p.SequenceNumber, Body: []byte("SIM\x00")})
+		case EnquireLink:
+			send(&PDU{CommandID: EnquireLinkResp, SequenceNumber: p.SequenceNumber})
+		case Unbind:
+			send(&PDU{CommandID: UnbindResp, SequenceNumber: p.SequenceNumber})
+			return
+		case SubmitSM:
+			m, err := ParseShortMessage(p.Body)
+			if !bound || err != nil {
+				send(&PDU{CommandID: SubmitSMResp, CommandStatus: StatusSysErr, SequenceNumber: p.SequenceNumber})
+				continue
+			}
+			s.mu.Lock()
+			s.nextID++
+			id := strconv.Itoa(s.nextID)
+			s.submitted = append(s.submitted, *m)
+			s.mu.Unlock()
+			send(&PDU{CommandID: SubmitSMResp, SequenceNumber: p.SequenceNumber, Body: append([]byte(id), 0)})
+
+			if m.RegisteredDelivery&RegisteredDeliveryAll != 0 {
+				go func() {
+					time.Sleep(s.ReceiptDelay)
+					stat := s.ReceiptStat
+					if stat == "" {
+						stat = StatDelivered
+					}
+					now := time.Now()
+					r := Receipt{ID: id, Submitted: "001", Delivered: "001", SubmitDate: now, DoneDate: now, Stat: stat, Err: "000"}
+					dm := ShortMessage{
+						SourceTON:  m.DestTON,
+						SourceNPI:  m.DestNPI,
+						SourceAddr: m.DestAddr,
+						DestTON:    m.SourceTON,
+						DestNPI:    m.SourceNPI,
+						DestAddr:   m.SourceAddr,
+						EsmClass:   EsmClassReceipt,
+						Message:    []byte(r.Format()),
+					}
+					wmu.Lock()
+					seq++
+					n := seq
+					wmu.Unlock()
+					send(&PDU{CommandID: DeliverSM, SequenceNumber: n, Body: dm.Body()})
+				}()
+			}
+		case DeliverSMResp:
+			s.mu.Lock()
+			s.receipts = append(s.receipts, p.CommandStatus)
+			s.mu.Unlock()
+		case EnquireLinkResp:
+		default:
+			send(&PDU{CommandID: GenericNack, CommandStatus: StatusInvalidCmd, SequenceNumber: p.SequenceNumber})
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+
+	"github.com/IMQS/messaging/smpp"
+)
+
+func init() {
+	RegisterSender("SMPP", newSMPPSender)
+}
+
+// ConfigSMPPProvider defines an SMPP v3.4 transceiver bind to an operator's
+// SMSC.  It is read from the "smpp" field of the provider's config block.
+type ConfigSMPPProvider struct {
+	Address         string // host:port of the SMSC
+	SystemID        string
+	Password        string
+	SystemType      string
+	SourceAddr      string // Sender address. Defaults to the message's From
+	SourceTON       byte
+	SourceNPI       byte
+	DestTON         byte   // Defaults to 1 (international) if both DestTON and DestNPI are 0
+	DestNPI         byte   // Defaults to 1 (ISDN) if both DestTON and DestNPI are 0
+	EnquireLink     string // Interval between keepalive requests. Defaults to 30s
+	Timeout         string // Time to wait for the SMSC to respond. Defaults to 10s
+	DisableReceipts bool   // Don't request delivery receipts
+}
+
+// SMPPSender sends messages over a persistent SMPP bind.  Delivery receipts
+// are received over the same bind and update the message status directly,
+// so the status of these messages is never polled.
+type SMPPSender struct {
+	config ConfigSMPPProvider
+	client *smpp.Client
+}
+
+func newSMPPSender(raw json.RawMessage) (SMSSender, error) {
+	var c struct {
+		SMPP ConfigSMPPProvider
+	}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, err
+	}
+	sc := c.SMPP
+	if sc.Address == "" {
+		return nil, errors.New("smpp.address is not configured")
+	}
+	if sc.DestTON == 0 && sc.DestNPI == 0 {
+		sc.DestTON, sc.DestNPI = 1, 1
+	}
+	p := &SMPPSender{
+		config: sc,
+		client: &smpp.Client{
+			Addr:        sc.Address,
+			Bind:        smpp.Bind{SystemID: sc.SystemID, Password: sc.Password, SystemType: sc.SystemType},
+			EnquireLink: parseDurationOrDefault(sc.EnquireLink, "30s"),
+			Timeout:     parseDurationOrDefault(sc.Timeout, "10s"),
+		},
+	}
+	return p, nil
+}
+
+// Start binds to the SMSC in the background, and handles delivery receipts as
+// they arrive.
+func (p *SMPPSender) Start(s *MessagingServer) error {
+	p.client.OnDeliver = func(m *smpp.ShortMessage) error {
+		return p.handleDeliver(s, m)
+	}
+	p.client.OnError = func(err error) {
+		s.Log.Warnf("SMPP bind to %v lost: %v", p.config.Address, err)
+	}
+	p.client.Start()
+	return nil
+}
+
+// Close unbinds from the SMSC
+func (p *SMPPSender) Close() error {
+	return p.client.Close()
+}
+
+// PushesReceipts reports whether delivery receipts are requested from the SMSC
+func (p *SMPPSender) PushesReceipts() bool {
+	return !p.config.DisableReceipts
+}
+
+// SendSMS submits the message to each destination, split into concatenated
+// parts if it is too long for a single message.  The message ID of the first
+// part identifies the message.  If the bind fails partway through, the results
+// of the destinations already submitted are returned with the error, so that a
+// retry only sends to the remaining destinations.
+func (p *SMPPSender) SendSMS(s *MessagingServer, m Message) ([]SendSMSResponseMessage, error) {
+	if !p.client.WaitBound(p.client.Timeout) {
+		return nil, smpp.ErrNotBound
+	}
+
+	src := p.config.SourceAddr
+	if src == "" {
+		src = m.From
+	}
+	var rd byte
+	if !p.config.DisableReceipts {
+		rd = smpp.RegisteredDeliveryAll
+	}
+
+	enc := m.Encoding
+	if enc == "" {
+		enc = detectEncoding(m.Text)
+	}
+	text, canSplit := encodeMessage(m.Text, enc)
+	dc, single, part := smpp.DataCodingDefault, gsm7SingleLength, gsm7PartLength
+	if enc == EncodingUCS2 {
+		dc, single, part = smpp.DataCodingUCS2, 2*ucs2SingleLength, 2*ucs2PartLength
+	}
+
+	var msRess []SendSMSResponseMessage
+	var firstErr error
+	for _, n := range m.Destination {
+		parts := smpp.SplitAt(text, single, part, byte(rand.Intn(256)), canSplit)
+		msRes := SendSMSResponseMessage{To: n, Segments: len(parts)}
+		for i, part := range parts {
+			sm := &smpp.ShortMessage{
+				SourceTON:          p.config.SourceTON,
+				SourceNPI:          p.config.SourceNPI,
+				SourceAddr:         src,
+				DestTON:            p.config.DestTON,
+				DestNPI:            p.config.DestNPI,
+				DestAddr:           n,
+				RegisteredDelivery: rd,
+				DataCoding:         dc,
+				Message:            part,
+			}
+			if len(parts) > 1 {
+				sm.EsmClass = smpp.EsmClassUDHI
+			}
+			id, err := p.client.Submit(sm)
+			if err != nil {
+				if _, ok := err.(*smpp.StatusError); !ok {
+					// The bind failed, the rest of the batch can't be sent either
+					return msRess, err
+				}
+				msRes.ErrorCode = err.(*smpp.StatusError).ErrorCode()
+				msRes.ErrorDesc = err.Error()
+				if firstErr == nil {
+					firstErr = err
+				}
+				break
+			}
+			if i == 0 {
+				msRes.MessageID = id
+			}
+		}
+		msRess = append(msRess, msRes)
+	}
+
+	for _, r := range msRess {
+		if r.sent() {
+			return msRess, nil
+		}
+	}
+	return msRess, firstErr
+}
+
+// GetStatus does not query the SMSC, since the status is updated from delivery
+// receipts.  The message is reported as sent until its receipt arrives.
+func (p *SMPPSender) GetStatus(s *MessagingServer, m Message) ([]SendSMSResponseMessage, error) {
+	return []SendSMSResponseMessage{{MessageID: m.ProviderID, ErrorCode: Sent, ErrorDesc: Sent}}, nil
+}
+
+// handleDeliver updates the status of a message from its delivery receipt.  It
+// only returns an error if the status could not be stored, so that the SMSC
+// delivers the receipt again.  Other messages, and receipts for messages that
+// are not known, are ignored.
+func (p *SMPPSender) handleDeliver(s *MessagingServer, m *smpp.ShortMessage) error {
+	if m.EsmClass&smpp.EsmClassReceipt == 0 {
+		return nil // Only delivery receipts are handled
+	}
+	r, err := smpp.ParseReceipt(string(m.Message))
+	if err != nil {
+		s.Log.Warnf("SMPP: %v", err)
+		return nil
+	}
+	sendLogID, err := s.DB.getSendLogID(r.ID)
+	if err == errUnknownMessage {
+		s.Log.Warnf("SMPP receipt for message %v: %v", r.ID, err)
+		return nil
+	}
+	if err == nil {
+		st := smppMapStat(r.Stat)
+		err = s.DB.updateSMSData(r.ID, st, r.Stat, r.Stat, statusSourceCallback, sendLogID, 0)
+	}
+	if err != nil {
+		s.Log.Errorf("SMPP receipt for message %v: %v", r.ID, err)
+	}
+	return err
+}
+
+func smppMapStat(stat string) string {
+	switch stat {
+	case smpp.StatDelivered:
+		return Delivered
+	case smpp.StatExpired, smpp.StatDeleted, smpp.StatUndeliverable, smpp.StatRejected:
+		return Failed
+	}
+	return Sent // no final status available
+}
@@ -0,0 +1,144 @@
+package messaging
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IMQS/messaging/smpp"
+)
+
+// queryArgs receives the arguments of every query made through the "recorder"
+// database driver, which fails every query.  This shows which messages the
+// server tried to look up or update, without needing a database.
+var queryArgs = make(chan []driver.Value, 100)
+
+func init() {
+	sql.Register("recorder", recorderDriver{})
+}
+
+type recorderDriver struct{}
+type recorderConn struct{}
+type recorderStmt struct{}
+
+func (recorderDriver) Open(name string) (driver.Conn, error) { return recorderConn{}, nil }
+
+func (recorderConn) Prepare(query string) (driver.Stmt, error) { return recorderStmt{}, nil }
+func (recorderConn) Close() error                              { return nil }
+func (recorderConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("Transactions are not supported")
+}
+
+func (recorderStmt) Close() error  { return nil }
+func (recorderStmt) NumInput() int { return -1 }
+func (recorderStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, record(args)
+}
+func (recorderStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, record(args)
+}
+
+func record(args []driver.Value) error {
+	select {
+	case queryArgs <- args:
+	default:
+	}
+	return errors.New("Not a database")
+}
+
+func TestSMPPSender(t *testing.T) {
+	sim, err := smpp.NewSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	sim.Bind = smpp.Bind{SystemID: "imqs", Password: "secret"}
+
+	raw, _ := json.Marshal(map[string]interface{}{
+		"smpp": ConfigSMPPProvider{Address: sim.Addr(), SystemID: "imqs", Password: "secret", Timeout: "5s"},
+	})
+	sender, err := newSMPPSender(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := sender.(*SMPPSender)
+	db, _ := sql.Open("recorder", "")
+	s := testServer()
+	s.DB = sqlNotifyDB{db: db}
+	p.Start(s)
+	defer p.Close()
+
+	// Too long for a single message, so it is sent in two parts
+	m := Message{Destination: []string{"27830000001"}, From: "IMQS", Text: strings.Repeat("Water supply interrupted. ", 8)}
+	resp, err := p.SendSMS(s, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || !resp[0].sent() || resp[0].MessageID == "" || resp[0].Segments != 2 {
+		t.Fatalf("Unexpected results %+v", resp)
+	}
+
+	sub := sim.Submitted()
+	if len(sub) != 2 {
+		t.Fatalf("Expected 2 parts to be submitted, got %v", len(sub))
+	}
+	var text []byte
+	for _, sm := range sub {
+		if sm.DestAddr != "27830000001" || sm.EsmClass&smpp.EsmClassUDHI == 0 || sm.RegisteredDelivery != smpp.RegisteredDeliveryAll {
+			t.Errorf("Unexpected part %+v", sm)
+		}
+		text = append(text, sm.Message[6:]...) // Skip the 6 byte concatenation header
+	}
+	if string(text) != m.Text {
+		t.Errorf("Parts do not make up the message: %q", text)
+	}
+
+	// The receipt of the first part identifies the message, and is looked up by its provider ID
+	timeout := time.After(5 * time.Second)
+	for found := false; !found; {
+		select {
+		case args := <-queryArgs:
+			found = len(args) == 1 && args[0] == resp[0].MessageID
+		case <-timeout:
+			t.Fatal("The delivery receipt did not reach the server")
+		}
+	}
+
+	// The status can't be stored without a database, so the SMSC is asked to deliver both receipts again
+	for len(sim.ReceiptResponses()) < 2 {
+		select {
+		case <-timeout:
+			t.Fatalf("Expected responses to 2 receipts, got %v", sim.ReceiptResponses())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	for _, st := range sim.ReceiptResponses() {
+		if st != smpp.StatusRxTAppn {
+			t.Errorf("Expected receipts to be rejected with ESME_RX_T_APPN, got status %v", st)
+		}
+	}
+}
+
+func TestSMPPSenderClose(t *testing.T) {
+	sim, err := smpp.NewSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	raw, _ := json.Marshal(map[string]interface{}{"smpp": ConfigSMPPProvider{Address: sim.Addr()}})
+	sender, err := newSMPPSender(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.(*SMPPSender).Start(testServer())
+	if err := sender.(*SMPPSender).Close(); err != nil {
+		t.Error(err)
+	}
+	if err := sender.(*SMPPSender).Close(); err != nil {
+		t.Error(err)
+	}
+}
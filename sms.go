@@ -1,64 +1,232 @@
 package messaging
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 const (
 	Delivered = "delivered"
 	Failed    = "failed"
 	Sent      = "sent"
+	Queued    = "queued"
+)
+
+// Channels that messages are sent through, as recorded in the type of a campaign and sendlog entry
+const (
+	channelSMS   = "sms"
+	channelEmail = "email"
 )
 
+// Outbound queue entry states, in addition to Queued
+const (
+	processing = "processing"
+	done       = "done"
+)
+
+// SMSSender is implemented by each SMS provider.  New providers are made
+// available with RegisterSender.
 type SMSSender interface {
-	SendSMS(s *MessagingServer, m message) ([]SendSMSResponseMessage, error)
-	GetStatus(s *MessagingServer, m message) ([]SendSMSResponseMessage, error)
+	SendSMS(s *MessagingServer, m Message) ([]SendSMSResponseMessage, error)
+	GetStatus(s *MessagingServer, m Message) ([]SendSMSResponseMessage, error)
 }
 
-// The message struct is used to define a new SMS message that needs to be sent
+// The Message struct is used to define a new SMS message that needs to be sent
 // to a list of mobile numbers (Destination).
-type message struct {
+type Message struct {
 	ID          string            // The internal ID from the database
 	ProviderID  string            // The ID assigned by the SMS provider in the send response
 	Destination []string          // List of string mobile numbers to send to
 	Text        string            // The text message to send
 	From        string            // Optional, provide a description for the sender
+	Encoding    string            // EncodingGSM7 or EncodingUCS2, which providers must pass on with the text
 	Provider    ConfigSmsProvider // SMS Provider to send the messages through
 }
 
+// RecipientMessage is the text to send to a single recipient
+type RecipientMessage struct {
+	MSISDN string
+	Text   string
+}
+
 // SendSMSResponseMessage struct represents the response of a message contained
 // within a "send" API call.
 type SendSMSResponseMessage struct {
-	To        string
-	MessageID string
-	ErrorCode string
-	ErrorDesc string
-	Segments  int
+	To        string `json:"to"`
+	MessageID string `json:"messageId"`
+	ErrorCode string `json:"errorCode"`
+	ErrorDesc string `json:"errorDescription"`
+	Segments  int    `json:"segments"`
+	RawStatus string `json:"-"` // Status code as reported by the provider, in response to a status request
+}
+
+// sent reports whether the provider accepted the message for delivery.
+func (m SendSMSResponseMessage) sent() bool {
+	return m.ErrorCode == "" || m.ErrorCode == "0"
+}
+
+// SendResult is the outcome of a single send request. Every send request is
+// recorded as a campaign, which is split into one or more batches depending on
+// the provider that each number is routed to, and the provider's MaxBatchSize.
+type SendResult struct {
+	CampaignID string        `json:"refNumber"`
+	Queued     int           `json:"queued,omitempty"` // Number of messages left on the outbound queue
+	Batches    []BatchResult `json:"batches"`
+}
+
+// BatchResult is the outcome of one batch within a campaign.  Each batch has
+// its own sendlog entry.
+type BatchResult struct {
+	Batch             int                      `json:"batch"`
+	SendLogID         string                   `json:"sendLogId"`
+	Provider          string                   `json:"provider"`
+	Recipients        int                      `json:"recipients"`
+	Attempts          int                      `json:"attempts"`
+	SendSuccess       bool                     `json:"sendSuccess"`
+	StatusDescription string                   `json:"statusDescription"`
+	Messages          []SendSMSResponseMessage `json:"messages,omitempty"`
 }
 
-func (s *MessagingServer) getSender(n string) SMSSender {
-	m := map[string]SMSSender{
-		"Clickatell":   ClickatellSender{},
-		"MockProvider": MockProviderSender{},
+// CampaignStatus is the progress of a campaign as recorded in the DB.  Batches are
+// only listed once they have been sent.
+type CampaignStatus struct {
+	RefNumber         string        `json:"refNumber"`
+	Status            string        `json:"status"`
+	StatusDescription string        `json:"statusDescription"`
+	Quantity          int           `json:"quantity"`
+	Queued            int           `json:"queued"`
+	Delivered         int           `json:"delivered"`
+	Failed            int           `json:"failed"`
+	Sent              int           `json:"sent"` // Messages without a final delivery status
+	LastStatusTime    *time.Time    `json:"lastStatusTime"`
+	Batches           []BatchResult `json:"batches"`
+}
+
+// MessagesSent returns the number of messages accepted by the provider across all batches.
+func (r *SendResult) MessagesSent() int {
+	n := 0
+	for _, b := range r.Batches {
+		for _, m := range b.Messages {
+			if b.SendSuccess && m.sent() {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// FailedBatches returns the number of batches that could not be sent.
+func (r *SendResult) FailedBatches() int {
+	n := 0
+	for _, b := range r.Batches {
+		if !b.SendSuccess {
+			n++
+		}
 	}
-	return m[n]
+	return n
+}
+
+// Err summarises the failed batches, if any, into a single error.
+func (r *SendResult) Err() error {
+	f := r.FailedBatches()
+	if f == 0 {
+		return nil
+	}
+	for _, b := range r.Batches {
+		if !b.SendSuccess {
+			if f == 1 {
+				return fmt.Errorf("Batch %v of %v failed: %v", b.Batch, len(r.Batches), b.StatusDescription)
+			}
+			return fmt.Errorf("%v of %v batches failed, first failure in batch %v: %v", f, len(r.Batches), b.Batch, b.StatusDescription)
+		}
+	}
+	return nil
 }
 
 // SendSMSMessages implements REST APIs for SMS providers, as configured in the config.
-// It also stores all messages in a DB for later reference
-func (s *MessagingServer) SendSMSMessages(msg, eml string, ns []string) (string, error) {
-	s.Log.Debugf("User %v sending message '%v' to %v recipients.", eml, msg, len(ns))
+// It also stores all messages in a DB for later reference.  The returned result
+// contains the outcome of every batch, even when some of the batches failed.
+// If the outbound queue is enabled, the messages are only queued and the result
+// contains the reference number of the campaign without any batches.
+func (s *MessagingServer) SendSMSMessages(msg, eml string, ns []string) (SendResult, error) {
+	rms := make([]RecipientMessage, len(ns))
+	for i, n := range ns {
+		rms[i] = RecipientMessage{MSISDN: n, Text: msg}
+	}
+	return s.SendPersonalisedSMS(msg, eml, rms)
+}
+
+// SendPersonalisedSMS sends each recipient its own text, such as a template
+// rendered with the recipient's variables.  The campaign records msg, which is
+// normally the template.  Recipients that are sent the same text share batches.
+func (s *MessagingServer) SendPersonalisedSMS(msg, eml string, rms []RecipientMessage) (SendResult, error) {
+	s.Log.Debugf("User %v sending message '%v' to %v recipients.", eml, msg, len(rms))
 
 	if !s.Config.SMSProvider.Enabled {
-		return "", errors.New("SendSMS disabled in config, not sending")
+		return SendResult{}, errors.New("SendSMS disabled in config, not sending")
 	}
 
-	sendID, err := splitBatchAndSend(msg, eml, ns, s) // Split message into batches if required by provider
+	if s.Config.Queue.Enabled {
+		return s.enqueueSMS(msg, eml, rms)
+	}
 
-	return sendID, err
+	res, err := splitBatchAndSend(msg, eml, rms, s) // Split message into batches if required by provider
+	if err != nil {
+		return res, err
+	}
+	return res, res.Err()
+}
+
+// GetMessageInfo calculates the encoding and segments of a message, checks it
+// against the configured maximum number of segments, and estimates the cost of
+// sending it.  If numbers are given they are routed like a send request, so the
+// estimate uses the cost of the provider that each number would be sent
+// through.  Otherwise the estimate is for the given number of recipients on the
+// primary provider.
+func (s *MessagingServer) GetMessageInfo(text, originator string, ns []string, recipients int) MessageInfo {
+	info := calculateMessage(text)
+	info.MaxSegments = s.Config.SMSProvider.MaxMessageSegments
+	switch {
+	case text == "":
+		info.ValidationMessage = "Message is empty"
+	case info.Segments > info.MaxSegments:
+		info.ValidationMessage = fmt.Sprintf("Message exceeds max allowed length (%v segments, %v encoding)", info.MaxSegments, info.Encoding)
+	default:
+		info.Valid = true
+	}
+
+	routes := []providerRoute{{Provider: s.Config.SMSProvider}}
+	if ns != nil {
+		routes = s.routeNumbers(originator, ns)
+	}
+	info.CostPerProvider = []Cost{}
+	for _, r := range routes {
+		n := len(r.MSISDNs)
+		if ns == nil {
+			n = recipients
+		}
+		c := Cost{
+			Provider:   r.Provider.key(),
+			Recipients: n,
+			Segments:   n * info.Segments,
+			Cost:       float64(n*info.Segments) * r.Provider.CostPerSegment,
+		}
+		info.Recipients += c.Recipients
+		info.EstimatedCost += c.Cost
+		info.CostPerProvider = append(info.CostPerProvider, c)
+	}
+	return info
+}
+
+// GetCampaignStatus retrieves the progress of a campaign by its reference number
+func (s *MessagingServer) GetCampaignStatus(refNumber string) (CampaignStatus, error) {
+	return s.DB.getCampaignStatus(refNumber)
 }
 
 // GetNumberStatus retrieves the delivery status of the last-sent message to a specific MSISDN
 func (s *MessagingServer) GetNumberStatus(n string) (string, error) {
-	mID, sendLogID, st, err := s.DB.getLastSMSID(n)
+	mID, sendLogID, pKey, st, err := s.DB.getLastSMSID(n)
 	if err != nil {
 		return "", err
 	}
@@ -67,13 +235,20 @@ func (s *MessagingServer) GetNumberStatus(n string) (string, error) {
 		return st, nil
 	}
 
-	stDesc, err := getStatus(mID, sendLogID, s)
+	stDesc, err := getStatus(mID, sendLogID, pKey, s)
 	return stDesc, err
 }
 
-func getStatus(apiID, sendLogID string, s *MessagingServer) (string, error) {
-	m := message{ProviderID: apiID}
-	smsSender := s.getSender(s.Config.SMSProvider.Name)
+func getStatus(apiID, sendLogID, providerKey string, s *MessagingServer) (string, error) {
+	p, ok := s.Config.provider(providerKey)
+	if !ok {
+		return "", fmt.Errorf("GetStatus: Provider %v is not configured", providerKey)
+	}
+	m := Message{ProviderID: apiID, Provider: p}
+	smsSender, err := s.getSender(p)
+	if err != nil {
+		return "", err
+	}
 	resp, err := smsSender.GetStatus(s, m)
 
 	if err != nil {
@@ -81,7 +256,7 @@ func getStatus(apiID, sendLogID string, s *MessagingServer) (string, error) {
 	}
 	stCode := resp[0].ErrorCode
 
-	if err := s.DB.updateSMSData(apiID, stCode, resp[0].ErrorDesc, sendLogID, resp[0].Segments); err != nil {
+	if err := s.DB.updateSMSData(apiID, stCode, resp[0].ErrorDesc, resp[0].RawStatus, statusSourcePoll, sendLogID, resp[0].Segments); err != nil {
 		return "", errors.New("SendSMS DB error")
 	}
 
@@ -89,7 +264,8 @@ func getStatus(apiID, sendLogID string, s *MessagingServer) (string, error) {
 }
 
 // UpdateStatus is executed on an interval, finding all unresolved delivery
-// statusses from the 30 minutes and retrieving it from the service provider
+// statusses from the 30 minutes and retrieving it from the service provider.
+// Messages sent through providers that push delivery receipts are skipped.
 func UpdateStatus(s *MessagingServer) {
 	aIDs, err := s.DB.getUnresolvedIDs("30m")
 
@@ -97,60 +273,113 @@ func UpdateStatus(s *MessagingServer) {
 		s.Log.Errorf("UpdateStatus failed: %v", err)
 	}
 	for x := 0; x < len(aIDs); x++ {
-		getStatus(aIDs[x][0], aIDs[x][1], s)
+		if p, ok := s.Config.provider(aIDs[x][2]); ok && s.pushesReceipts(p) {
+			continue
+		}
+		getStatus(aIDs[x][0], aIDs[x][1], aIDs[x][2], s)
 	}
 
 }
 
-func splitBatchAndSend(msg, eml string, ns []string, s *MessagingServer) (string, error) {
-	var err error
-	var sendID string
+// splitBatchAndSend creates a campaign for the message, routes each number to a
+// provider, groups the numbers by their text and sends them in batches of at most the provider's MaxBatchSize
+// numbers.  A failed batch does not prevent the remaining batches from being
+// sent.  The returned error is only set if the DB could not be updated.
+func splitBatchAndSend(msg, eml string, rms []RecipientMessage, s *MessagingServer) (SendResult, error) {
+	var res SendResult
+
+	routes := s.routeMessages(eml, rms)
+	nb := 0
+	for _, rt := range routes {
+		nb += rt.Provider.batchCount(len(rt.MSISDNs))
+	}
 
-	bs := s.Config.SMSProvider.MaxBatchSize
-	ratio := float32(len(ns)) / float32(bs)
+	cID, err := s.DB.createCampaign(channelSMS, msg, eml, len(rms), nb)
+	if err != nil {
+		return res, errors.New("SendSMS DB error")
+	}
+	res.CampaignID = cID
 
-	// BUG(dbf): We are losing the full result set and only returning the final sendID and err
-	for ratio > 0 {
-		if ratio > 1 {
-			sendID, err = sendSMSBatch(msg, eml, ns[:bs], s)
-			ns = ns[bs:]
-			ratio = float32(len(ns)) / float32(bs)
-		} else {
-			sendID, err = sendSMSBatch(msg, eml, ns, s)
-			return sendID, err
+	b := 1
+	for _, rt := range routes {
+		bs := rt.Provider.batchSize(len(rt.MSISDNs))
+		for rns := rt.MSISDNs; len(rns) > 0; b++ {
+			n := bs
+			if n > len(rns) {
+				n = len(rns)
+			}
+			br, err := sendSMSBatch(rt.Text, eml, rns[:n], cID, b, rt.Provider, s)
+			if err != nil {
+				return res, err
+			}
+			res.Batches = append(res.Batches, br)
+			rns = rns[n:]
 		}
 	}
 
-	return sendID, err
+	st, stDesc := "success", ""
+	if err := res.Err(); err != nil {
+		st, stDesc = "failed", err.Error()
+	}
+	if err := s.DB.updateCampaign(cID, res.FailedBatches(), st, stDesc); err != nil {
+		return res, errors.New("SendSMS DB error")
+	}
+	return res, nil
 }
 
-func sendSMSBatch(msg, eml string, ns []string, s *MessagingServer) (string, error) {
-	m := message{
-		Destination: ns,
-		Text:        msg,
-		From:        "IMQS",
-		Provider:    s.Config.SMSProvider,
+// sendSMSBatch sends a batch through the provider it was routed to, or through
+// the provider's secondary if the primary is unavailable, and records the outcome.
+func sendSMSBatch(msg, eml string, ns []string, campaignID string, batch int, p ConfigSmsProvider, s *MessagingServer) (BatchResult, error) {
+	var resp []SendSMSResponseMessage
+	var attempts []sendAttempt
+	enc := detectEncoding(msg)
+	p, breaker, sendErr := s.selectProvider(p)
+	if sendErr == nil {
+		m := Message{
+			Destination: ns,
+			Text:        msg,
+			From:        "IMQS",
+			Encoding:    enc,
+			Provider:    p,
+		}
+		var smsSender SMSSender
+		if smsSender, sendErr = s.getSender(p); sendErr == nil {
+			resp, attempts, sendErr = sendWithRetry(s, smsSender, m)
+			// A permanent rejection means the provider is up, so only
+			// failures that are worth retrying count towards the breaker
+			if p.Retry.isRetryable(sendErr) {
+				breaker.record(s, sendErr)
+			} else {
+				breaker.record(s, nil)
+			}
+		}
 	}
-	smsSender := s.getSender(s.Config.SMSProvider.Name)
-	resp, sendErr := smsSender.SendSMS(s, m)
 
-	sendID, err := s.DB.createSMSData(msg, eml, resp, sendErr)
+	sendID, err := s.DB.createSMSData(msg, eml, campaignID, batch, p.key(), enc, resp, sendErr)
 	if err != nil {
-		return "", errors.New("SendSMS DB error")
+		return BatchResult{}, errors.New("SendSMS DB error")
+	}
+	if err := s.DB.createSendAttempts(sendID, attempts); err != nil {
+		return BatchResult{}, errors.New("SendSMS DB error")
 	}
 
-	return sendID, sendErr
-}
-
-func allowOnlyASCII(str string) string {
-	b := make([]byte, len(str))
-	var bl int
-	for i := 0; i < len(str); i++ {
-		c := str[i]
-		if c >= 32 && c < 127 {
-			b[bl] = c
-			bl++
+	br := BatchResult{
+		Batch:       batch,
+		SendLogID:   sendID,
+		Provider:    p.key(),
+		Recipients:  len(ns),
+		Attempts:    len(attempts),
+		SendSuccess: sendErr == nil,
+		Messages:    resp,
+	}
+	if sendErr != nil {
+		br.StatusDescription = sendErr.Error()
+		if len(br.Messages) == 0 {
+			// The provider rejected the batch as a whole, so report the failure against each recipient
+			for _, n := range ns {
+				br.Messages = append(br.Messages, SendSMSResponseMessage{To: n, ErrorCode: Failed, ErrorDesc: br.StatusDescription})
+			}
 		}
 	}
-	return string(b[:bl])
+	return br, nil
 }
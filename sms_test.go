@@ -0,0 +1,107 @@
+package messaging
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"testing"
+)
+
+// The "counter" database driver accepts every statement, and answers every
+// query with a single row holding the next ID.  This is enough for the server
+// to record a send without a database.
+func init() {
+	sql.Register("counter", counterDriver{})
+}
+
+var counterID struct {
+	sync.Mutex
+	n int64
+}
+
+type counterDriver struct{}
+type counterConn struct{}
+type counterStmt struct{}
+type counterRows struct{ done bool }
+
+func (counterDriver) Open(name string) (driver.Conn, error) { return counterConn{}, nil }
+
+func (counterConn) Prepare(query string) (driver.Stmt, error) { return counterStmt{}, nil }
+func (counterConn) Close() error                              { return nil }
+func (counterConn) Begin() (driver.Tx, error)                 { return counterConn{}, nil }
+func (counterConn) Commit() error                             { return nil }
+func (counterConn) Rollback() error                           { return nil }
+
+func (counterStmt) Close() error  { return nil }
+func (counterStmt) NumInput() int { return -1 }
+func (counterStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (counterStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &counterRows{}, nil
+}
+
+func (r *counterRows) Columns() []string { return []string{"id"} }
+func (r *counterRows) Close() error      { return nil }
+func (r *counterRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	counterID.Lock()
+	defer counterID.Unlock()
+	counterID.n++
+	dest[0] = counterID.n
+	return nil
+}
+
+func TestSplitBatchAndSend(t *testing.T) {
+	db, _ := sql.Open("counter", "")
+	mock := ConfigSmsProvider{Name: "MockProvider", MaxBatchSize: 2}
+	missing := ConfigSmsProvider{Name: "Missing", Enabled: true, Routing: ConfigRouting{CountryCodes: []string{"264"}}}
+	rm := func(n, text string) RecipientMessage { return RecipientMessage{MSISDN: n, Text: text} }
+
+	for _, c := range []struct {
+		name    string
+		rms     []RecipientMessage
+		batches []int // Recipients per batch
+		failed  int
+		sent    int
+	}{
+		{"single batch", []RecipientMessage{rm("27820000001", "a"), rm("27820000002", "a")}, []int{2}, 0, 2},
+		{"split by size", []RecipientMessage{rm("27820000001", "a"), rm("27820000002", "a"), rm("27820000003", "a")}, []int{2, 1}, 0, 3},
+		{"split by text", []RecipientMessage{rm("27820000001", "a"), rm("27820000002", "b"), rm("27820000003", "a")}, []int{2, 1}, 0, 3},
+		{"failed route", []RecipientMessage{rm("27820000001", "a"), rm("264810000001", "a"), rm("264810000002", "a")}, []int{1, 2}, 1, 1},
+	} {
+		s := testServer()
+		s.DB = sqlNotifyDB{db: db}
+		s.Config.SMSProvider = mock
+		s.Config.SMSProviders = []ConfigSmsProvider{missing}
+
+		res, err := splitBatchAndSend("a", "test@imqs.co.za", c.rms, s)
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if res.CampaignID == "" {
+			t.Errorf("%v: Expected a campaign ID", c.name)
+		}
+		if len(res.Batches) != len(c.batches) {
+			t.Fatalf("%v: Expected %v batches, got %+v", c.name, len(c.batches), res.Batches)
+		}
+		for i, b := range res.Batches {
+			if b.Batch != i+1 || b.Recipients != c.batches[i] || len(b.Messages) != c.batches[i] {
+				t.Errorf("%v: Unexpected batch %+v", c.name, b)
+			}
+		}
+		if got := res.FailedBatches(); got != c.failed {
+			t.Errorf("%v: Expected %v failed batches, got %v", c.name, c.failed, got)
+		}
+		if got := res.MessagesSent(); got != c.sent {
+			t.Errorf("%v: Expected %v messages sent, got %v", c.name, c.sent, got)
+		}
+		if (res.Err() != nil) != (c.failed > 0) {
+			t.Errorf("%v: Unexpected error %v", c.name, res.Err())
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package messaging
+
+import (
+	"errors"
+	"time"
+)
+
+// Sources of the statuses in a message's timeline
+const (
+	statusSourceSend     = "send"     // The outcome of sending the message to the provider
+	statusSourcePoll     = "poll"     // Requested from the provider
+	statusSourceCallback = "callback" // Pushed by the provider
+	statusSourceManual   = "manual"   // Set through the API
+)
+
+// StatusEvent is a status that was received for a message
+type StatusEvent struct {
+	ID          string    `json:"id"`
+	RawCode     string    `json:"rawCode"` // The provider's status or error code
+	Status      string    `json:"status"`  // The status that RawCode maps to
+	Description string    `json:"description"`
+	Source      string    `json:"source"` // send, poll, callback or manual
+	Time        time.Time `json:"time"`
+}
+
+// MessageTimeline is a message along with every status that was received for it
+type MessageTimeline struct {
+	MessageStatus
+	Events []StatusEvent `json:"events"`
+}
+
+// MessageStatus is the delivery status of a single message
+type MessageStatus struct {
+	ID                string     `json:"id"`
+	MSISDN            string     `json:"msisdn"`
+	RefNumber         string     `json:"refNumber"`
+	SendLogID         string     `json:"sendLogId"`
+	Provider          string     `json:"provider"`
+	ProviderID        string     `json:"providerId"`
+	Status            string     `json:"status"` // delivered, failed, sent, or the provider's error code if it was not accepted
+	StatusDescription string     `json:"statusDescription"`
+	Segments          int        `json:"segments"`
+	SentTime          time.Time  `json:"sentTime"`
+	StatusTime        *time.Time `json:"statusTime"` // Time that the final status was received
+}
+
+// GetMessageStatus retrieves the status of the message with the provider's
+// message ID.  If the message has no final status yet, it is requested from
+// the provider first.
+func (s *MessagingServer) GetMessageStatus(providerID string) (MessageStatus, error) {
+	ms, err := s.DB.getMessageStatus(providerID)
+	if err != nil {
+		return ms, err
+	}
+	return s.refreshStatus(ms, func() (MessageStatus, error) { return s.DB.getMessageStatus(providerID) })
+}
+
+// GetLastMessageStatus retrieves the status of the last message sent to a
+// number, in the same way as GetMessageStatus.
+func (s *MessagingServer) GetLastMessageStatus(msisdn string) (MessageStatus, error) {
+	ms, err := s.DB.getLastMessageStatus(msisdn)
+	if err != nil {
+		return ms, err
+	}
+	return s.refreshStatus(ms, func() (MessageStatus, error) { return s.DB.getLastMessageStatus(msisdn) })
+}
+
+// GetMessageTimeline retrieves a message by its sms ID, along with every
+// status that was received for it.
+func (s *MessagingServer) GetMessageTimeline(id string) (MessageTimeline, error) {
+	var mt MessageTimeline
+	var err error
+	if mt.MessageStatus, err = s.DB.getMessageStatusByID(id); err != nil {
+		return mt, err
+	}
+	mt.Events, err = s.DB.listStatusEvents(id)
+	return mt, err
+}
+
+// SetMessageStatus records a final status for a message, e.g. when delivery was
+// confirmed outside of the provider.  The status of a message that already has a
+// final status is not changed, but the status is still added to its timeline.
+func (s *MessagingServer) SetMessageStatus(id, status, description string) error {
+	if status != Delivered && status != Failed {
+		return errors.New("Status must be delivered or failed")
+	}
+	ms, err := s.DB.getMessageStatusByID(id)
+	if err != nil {
+		return err
+	}
+	if ms.ProviderID == "" {
+		return errors.New("The message was not accepted by the provider")
+	}
+	return s.DB.updateSMSData(ms.ProviderID, status, description, "", statusSourceManual, ms.SendLogID, 0)
+}
+
+// refreshStatus requests the status of a message without a final status from
+// the provider, and reloads it.  If the provider can't be reached, the stored
+// status is returned.
+func (s *MessagingServer) refreshStatus(ms MessageStatus, reload func() (MessageStatus, error)) (MessageStatus, error) {
+	if ms.Status != Sent || ms.ProviderID == "" {
+		return ms, nil
+	}
+	if _, err := getStatus(ms.ProviderID, ms.SendLogID, ms.Provider, s); err != nil {
+		s.Log.Warnf("Could not retrieve the status of message %v: %v", ms.ProviderID, err)
+		return ms, nil
+	}
+	return reload()
+}
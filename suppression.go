@@ -0,0 +1,69 @@
+package messaging
+
+import (
+	"errors"
+	"time"
+)
+
+// Sources of suppression list entries
+const (
+	suppressionManual  = "manual"  // Added through the API
+	suppressionInbound = "inbound" // The recipient replied with an opt-out keyword
+)
+
+// Suppression is a number that must not be sent messages, except emergency messages
+type Suppression struct {
+	MSISDN      string    `json:"msisdn"`
+	Reason      string    `json:"reason"`
+	Source      string    `json:"source"`
+	CreatedBy   string    `json:"createdBy"`
+	CreatedTime time.Time `json:"createdTime"`
+}
+
+// SuppressNumbers adds the numbers to the suppression list.  The numbers are
+// cleaned first, and the cleaned numbers are returned.  A number that is already
+// on the list has its reason and source replaced.
+func (s *MessagingServer) SuppressNumbers(ns []string, reason, source, eml string) ([]string, error) {
+	cns := cleanMSISDNs(ns, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)
+	for _, n := range cns {
+		if err := s.DB.addSuppression(Suppression{MSISDN: n, Reason: reason, Source: source, CreatedBy: eml, CreatedTime: time.Now().UTC()}); err != nil {
+			return nil, err
+		}
+	}
+	return cns, nil
+}
+
+// UnsuppressNumber removes a number from the suppression list
+func (s *MessagingServer) UnsuppressNumber(n string) error {
+	cns := cleanMSISDNs([]string{n}, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)
+	if len(cns) == 0 {
+		return errors.New("Invalid msisdn")
+	}
+	return s.DB.removeSuppression(cns[0])
+}
+
+// filterSuppressed removes the messages to suppressed numbers, unless the
+// priority is emergency.  It returns the number of messages that were removed.
+func (s *MessagingServer) filterSuppressed(rms []RecipientMessage, priority string) ([]RecipientMessage, int, error) {
+	if priority == PriorityEmergency || len(rms) == 0 {
+		return rms, 0, nil
+	}
+	ns := make([]string, len(rms))
+	for i, rm := range rms {
+		ns[i] = rm.MSISDN
+	}
+	sup, err := s.DB.suppressedNumbers(ns)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(sup) == 0 {
+		return rms, 0, nil
+	}
+	var res []RecipientMessage
+	for _, rm := range rms {
+		if !sup[rm.MSISDN] {
+			res = append(res, rm)
+		}
+	}
+	return res, len(rms) - len(res), nil
+}
@@ -0,0 +1,185 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// templateVar matches a placeholder such as {{firstName}} in a template
+var templateVar = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+var templateName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Template is a stored message with placeholders such as {{firstName}}, which
+// are replaced with each recipient's variables when it is sent.  Every change to
+// a template creates a new version, and earlier versions remain available.
+type Template struct {
+	Name        string    `json:"name"`
+	Version     int       `json:"version"`
+	Body        string    `json:"body"`
+	Variables   []string  `json:"variables"`
+	CreatedBy   string    `json:"createdBy"`
+	CreatedTime time.Time `json:"createdTime"`
+}
+
+// Recipient is a number along with the values of the template's variables
+type Recipient struct {
+	MSISDN    string            `json:"msisdn"`
+	Variables map[string]string `json:"variables"`
+}
+
+// RecipientError describes why the message for a recipient can't be sent
+type RecipientError struct {
+	MSISDN           string   `json:"msisdn"`
+	MissingVariables []string `json:"missingVariables,omitempty"`
+	Description      string   `json:"description"`
+}
+
+// RenderError is returned when the message could not be rendered for one or
+// more recipients.  Nothing is sent if any recipient has an error.
+type RenderError struct {
+	Recipients []RecipientError `json:"recipients"`
+}
+
+func (e *RenderError) Error() string {
+	r := e.Recipients[0]
+	if len(e.Recipients) == 1 {
+		return fmt.Sprintf("Recipient %v: %v", r.MSISDN, r.Description)
+	}
+	return fmt.Sprintf("%v recipients are invalid, first is %v: %v", len(e.Recipients), r.MSISDN, r.Description)
+}
+
+// templateVariables returns the names of the placeholders in the body, sorted and without duplicates
+func templateVariables(body string) []string {
+	fnd := map[string]bool{}
+	vs := []string{}
+	for _, m := range templateVar.FindAllStringSubmatch(body, -1) {
+		if !fnd[m[1]] {
+			fnd[m[1]] = true
+			vs = append(vs, m[1])
+		}
+	}
+	sort.Strings(vs)
+	return vs
+}
+
+// renderTemplate replaces the placeholders in the body with the variables.  It
+// returns the names of any variables that are missing or empty, in which case
+// the rendered text must not be sent.
+func renderTemplate(body string, vars map[string]string) (string, []string) {
+	var missing []string
+	text := templateVar.ReplaceAllStringFunc(body, func(m string) string {
+		name := templateVar.FindStringSubmatch(m)[1]
+		v := strings.TrimSpace(vars[name])
+		if v == "" {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if missing != nil {
+		sort.Strings(missing)
+		ms := missing[:1]
+		for _, m := range missing[1:] {
+			if m != ms[len(ms)-1] {
+				ms = append(ms, m)
+			}
+		}
+		missing = ms
+	}
+	return text, missing
+}
+
+// SaveTemplate stores a new version of a template, or its first version if
+// the template does not exist yet.
+func (s *MessagingServer) SaveTemplate(name, body, eml string) (Template, error) {
+	if !templateName.MatchString(name) {
+		return Template{}, errors.New("Template name may only contain letters, digits, '_', '.' and '-'")
+	}
+	if strings.TrimSpace(body) == "" {
+		return Template{}, errors.New("Template body is empty")
+	}
+	t, err := s.DB.createTemplate(name, body, eml)
+	if err != nil {
+		return t, err
+	}
+	t.Variables = templateVariables(t.Body)
+	return t, nil
+}
+
+// GetTemplate retrieves a version of a template, or its latest version if version is 0
+func (s *MessagingServer) GetTemplate(name string, version int) (Template, error) {
+	t, err := s.DB.getTemplate(name, version)
+	if err != nil {
+		return t, err
+	}
+	t.Variables = templateVariables(t.Body)
+	return t, nil
+}
+
+// RenderMessages renders the body for each recipient, and checks that every
+// rendered message is within the configured number of segments.  Invalid and
+// duplicate numbers are removed, keeping the first occurrence.  If any
+// recipient is missing variables or its message is too long, a *RenderError
+// lists every such recipient.  The cleaned numbers, with the positions in rs of
+// the recipients that were cleaned to them, and the number of removed
+// recipients are returned along with the messages.
+func (s *MessagingServer) RenderMessages(body, eml string, rs []Recipient) ([]RecipientMessage, []MSISDNInputs, int, error) {
+	var rms []RecipientMessage
+	var rErrs []RecipientError
+	ns := make([]string, len(rs))
+	for i, r := range rs {
+		ns[i] = r.MSISDN
+	}
+	cns := mapMSISDNs(ns, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)
+	for _, cn := range cns {
+		r := rs[cn.Inputs[0]]
+		text, missing := renderTemplate(body, r.Variables)
+		if missing != nil {
+			rErrs = append(rErrs, RecipientError{
+				MSISDN:           r.MSISDN,
+				MissingVariables: missing,
+				Description:      "Missing variables: " + strings.Join(missing, ", "),
+			})
+			continue
+		}
+		if info := s.GetMessageInfo(text, eml, nil, 0); !info.Valid {
+			rErrs = append(rErrs, RecipientError{MSISDN: r.MSISDN, Description: info.ValidationMessage})
+			continue
+		}
+		rms = append(rms, RecipientMessage{MSISDN: cn.MSISDN, Text: text})
+	}
+	if rErrs != nil {
+		return nil, nil, 0, &RenderError{Recipients: rErrs}
+	}
+	return rms, cns, len(rs) - len(rms), nil
+}
+
+// SendTemplateSMS renders the template for each recipient and sends the
+// results.  Nothing is sent if the template can't be rendered for any of the
+// recipients.  Inline messages are sent with a template that has no name,
+// which is not recorded on the campaign.  The number of invalid or duplicate
+// recipients that were removed is returned along with the result.
+func (s *MessagingServer) SendTemplateSMS(t Template, eml string, rs []Recipient) (SendResult, int, error) {
+	rms, _, removed, err := s.RenderMessages(t.Body, eml, rs)
+	if err != nil {
+		return SendResult{}, 0, err
+	}
+	res, err := s.sendRendered(t, eml, rms)
+	return res, removed, err
+}
+
+// sendRendered sends messages that were rendered from the template, and records
+// the template on the campaign.
+func (s *MessagingServer) sendRendered(t Template, eml string, rms []RecipientMessage) (SendResult, error) {
+	res, err := s.SendPersonalisedSMS(t.Body, eml, rms)
+	if t.Name != "" && res.CampaignID != "" {
+		if tErr := s.DB.setCampaignTemplate(res.CampaignID, t.Name, t.Version); tErr != nil {
+			s.Log.Errorf("Could not record template of campaign %v: %v", res.CampaignID, tErr)
+		}
+	}
+	return res, err
+}
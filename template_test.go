@@ -0,0 +1,57 @@
+package messaging
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	body := "Dear {{name}}, your account {{ account }} is in arrears. Regards, {{name}}"
+	for _, c := range []struct {
+		vars    map[string]string
+		text    string
+		missing []string
+	}{
+		{map[string]string{"name": "Jan", "account": "123"}, "Dear Jan, your account 123 is in arrears. Regards, Jan", nil},
+		{map[string]string{"name": " Jan ", "account": "123", "unused": "x"}, "Dear Jan, your account 123 is in arrears. Regards, Jan", nil},
+		{map[string]string{"name": "Jan"}, "Dear Jan, your account  is in arrears. Regards, Jan", []string{"account"}},
+		{map[string]string{"name": "  ", "account": "123"}, "Dear , your account 123 is in arrears. Regards, ", []string{"name"}}, // Reported once
+		{nil, "Dear , your account  is in arrears. Regards, ", []string{"account", "name"}},
+	} {
+		text, missing := renderTemplate(body, c.vars)
+		if text != c.text || !reflect.DeepEqual(missing, c.missing) {
+			t.Errorf("renderTemplate(%v) = %q, %v, want %q, %v", c.vars, text, missing, c.text, c.missing)
+		}
+	}
+	if got := templateVariables(body); !reflect.DeepEqual(got, []string{"account", "name"}) {
+		t.Errorf("templateVariables() = %v", got)
+	}
+}
+
+func TestRenderMessagesMissingVariables(t *testing.T) {
+	s := testServer()
+	s.Config.SMSProvider = ConfigSmsProvider{Name: "MockProvider", Countries: []string{"ZA"}, MaxMessageSegments: 1}
+	rs := []Recipient{
+		{MSISDN: "0820000001", Variables: map[string]string{"name": "Jan"}},
+		{MSISDN: "0820000002"},
+		{MSISDN: "0820000003", Variables: map[string]string{"name": "Piet"}},
+	}
+	_, _, _, err := s.RenderMessages("Hello {{name}}", "", rs)
+	rErr, ok := err.(*RenderError)
+	if !ok {
+		t.Fatalf("Expected a *RenderError, got %v", err)
+	}
+	want := []RecipientError{{MSISDN: "0820000002", MissingVariables: []string{"name"}, Description: "Missing variables: name"}}
+	if !reflect.DeepEqual(rErr.Recipients, want) {
+		t.Errorf("Expected errors %+v, got %+v", want, rErr.Recipients)
+	}
+
+	rms, _, removed, err := s.RenderMessages("Hello {{name}}", "", []Recipient{rs[0], rs[2], rs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRms := []RecipientMessage{{MSISDN: "27820000001", Text: "Hello Jan"}, {MSISDN: "27820000003", Text: "Hello Piet"}}
+	if !reflect.DeepEqual(rms, wantRms) || removed != 1 {
+		t.Errorf("Expected %+v with 1 removed, got %+v with %v removed", wantRms, rms, removed)
+	}
+}
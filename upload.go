@@ -0,0 +1,193 @@
+package messaging
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Outcomes of an uploaded row
+const (
+	uploadValid     = "valid"
+	uploadInvalid   = "invalid"
+	uploadDuplicate = "duplicate"
+)
+
+// CSVOptions describes the layout of an uploaded recipient list.  Columns are
+// given by their name in the header row, or by their position, starting at 1.
+type CSVOptions struct {
+	Delimiter    rune              // Defaults to ','
+	Header       bool              // The first row contains the names of the columns
+	MSISDNColumn string            // Defaults to the first column
+	Variables    map[string]string // Template variable names and the columns they are read from
+}
+
+// UploadRow is the outcome of a single row of an uploaded recipient list
+type UploadRow struct {
+	Row         int               `json:"row"` // Number of the row, counting the header row and skipping blank lines
+	MSISDN      string            `json:"msisdn"`
+	Normalised  string            `json:"normalised,omitempty"`
+	Status      string            `json:"status"` // valid, invalid or duplicate
+	Reason      string            `json:"reason,omitempty"`
+	DuplicateOf int               `json:"duplicateOf,omitempty"` // Row that the number first occurred in
+	Variables   map[string]string `json:"variables,omitempty"`
+}
+
+// UploadReport is the outcome of every row of an uploaded recipient list.  The
+// valid rows are listed in Recipients, in the form accepted by /sendsms.
+type UploadReport struct {
+	Rows       []UploadRow `json:"rows"`
+	Valid      int         `json:"valid"`
+	Invalid    int         `json:"invalid"`
+	Duplicates int         `json:"duplicates"`
+	Recipients []Recipient `json:"recipients"`
+}
+
+// ParseRecipientCSV reads a recipient list, and cleans the number of every row.
+// Nothing is sent: the report allows the list to be checked before it is sent.
+func (s *MessagingServer) ParseRecipientCSV(r io.Reader, opts CSVOptions) (UploadReport, error) {
+	rep := UploadReport{Rows: []UploadRow{}, Recipients: []Recipient{}}
+	// Spreadsheet programs such as Excel start UTF-8 files with a byte order mark,
+	// which would otherwise become part of the first field
+	br := bufio.NewReader(r)
+	if c, _, err := br.ReadRune(); err == nil && c != '\uFEFF' {
+		br.UnreadRune()
+	}
+	cr := csv.NewReader(br)
+	if opts.Delimiter != 0 {
+		cr.Comma = opts.Delimiter
+	}
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.TrimLeadingSpace = true
+
+	row := 0
+	var header []string
+	if opts.Header {
+		var err error
+		if header, err = cr.Read(); err != nil {
+			return rep, errors.New("ParseRecipientCSV: Could not read header row")
+		}
+		row++
+	}
+	nCol, err := csvColumn(opts.MSISDNColumn, header)
+	if err != nil {
+		return rep, err
+	}
+	vCols := map[string]int{}
+	for name, col := range opts.Variables {
+		if vCols[name], err = csvColumn(col, header); err != nil {
+			return rep, err
+		}
+	}
+
+	fnd := map[string]int{}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		row++
+		if err != nil {
+			return rep, errors.New("ParseRecipientCSV: Could not read row " + strconv.Itoa(row) + ": " + err.Error())
+		}
+
+		ur := UploadRow{Row: row}
+		if nCol < len(rec) {
+			ur.MSISDN = strings.TrimSpace(rec[nCol])
+		}
+		for name, c := range vCols {
+			if c < len(rec) {
+				if ur.Variables == nil {
+					ur.Variables = map[string]string{}
+				}
+				ur.Variables[name] = strings.TrimSpace(rec[c])
+			}
+		}
+
+		ns := cleanMSISDNs([]string{ur.MSISDN}, s.Config.SMSProvider.Countries, s.Config.SMSProvider.MobileOnly)
+		switch {
+		case ur.MSISDN == "":
+			ur.Status = uploadInvalid
+			ur.Reason = "No number"
+			rep.Invalid++
+		case len(ns) == 0:
+			ur.Status = uploadInvalid
+			ur.Reason = "Not a valid number for the configured countries"
+			rep.Invalid++
+		case fnd[ns[0]] != 0:
+			ur.Normalised = ns[0]
+			ur.Status = uploadDuplicate
+			ur.DuplicateOf = fnd[ns[0]]
+			ur.Reason = "Duplicate of row " + strconv.Itoa(ur.DuplicateOf)
+			rep.Duplicates++
+		default:
+			ur.Normalised = ns[0]
+			ur.Status = uploadValid
+			fnd[ns[0]] = row
+			rep.Valid++
+			rep.Recipients = append(rep.Recipients, Recipient{MSISDN: ns[0], Variables: ur.Variables})
+		}
+		rep.Rows = append(rep.Rows, ur)
+	}
+	return rep, nil
+}
+
+// csvColumn returns the index of a column given by its position, starting at 1,
+// or by its name in the header row.  An empty column is the first column.
+func csvColumn(col string, header []string) (int, error) {
+	col = strings.TrimSpace(col)
+	if col == "" {
+		return 0, nil
+	}
+	if i, err := strconv.Atoi(col); err == nil {
+		if i < 1 {
+			return 0, errors.New("Column positions start at 1")
+		}
+		return i - 1, nil
+	}
+	for i, h := range header {
+		if strings.EqualFold(strings.TrimSpace(h), col) {
+			return i, nil
+		}
+	}
+	return 0, errors.New("Column '" + col + "' is not in the header row")
+}
+
+// parseCSVOptions reads the layout of an uploaded recipient list from form
+// values.  'variables' is a list of name=column pairs, e.g. "firstName=Name,stand=3".
+func parseCSVOptions(delimiter, header, msisdnColumn, variables string) (CSVOptions, error) {
+	opts := CSVOptions{Header: true, MSISDNColumn: msisdnColumn, Variables: map[string]string{}}
+	switch delimiter {
+	case "":
+	case "tab", `\t`:
+		opts.Delimiter = '\t'
+	default:
+		rs := []rune(delimiter)
+		if len(rs) != 1 || rs[0] == '"' || rs[0] == '\r' || rs[0] == '\n' {
+			return opts, errors.New("Delimiter must be a single character")
+		}
+		opts.Delimiter = rs[0]
+	}
+	if header != "" {
+		var err error
+		if opts.Header, err = strconv.ParseBool(header); err != nil {
+			return opts, errors.New("Header must be true or false")
+		}
+	}
+	for _, v := range strings.Split(variables, ",") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || !templateVar.MatchString("{{"+name+"}}") {
+			return opts, errors.New("Variables must be given as name=column")
+		}
+		opts.Variables[name] = kv[1]
+	}
+	return opts, nil
+}
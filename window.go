@@ -0,0 +1,218 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message priorities.  Normal messages are only sent within the send window of
+// the recipient's country, and are deferred to the next opening otherwise.
+// Urgent and emergency messages are always sent immediately.
+const (
+	PriorityNormal    = "normal"
+	PriorityUrgent    = "urgent"
+	PriorityEmergency = "emergency"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// sendWindow is a parsed ConfigSendWindow
+type sendWindow struct {
+	countryCodes []string
+	zone         string
+	loc          *time.Location
+	start, end   int // Minutes after midnight
+	days         map[time.Weekday]bool
+}
+
+// validPriority reports whether p is one of the message priorities.  An empty
+// priority is treated as normal.
+func validPriority(p string) bool {
+	switch p {
+	case "", PriorityNormal, PriorityUrgent, PriorityEmergency:
+		return true
+	}
+	return false
+}
+
+func parseClock(c string) (int, error) {
+	t, err := time.Parse("15:04", c)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %v", c)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// sendWindows parses the configured send windows.  A window without country
+// codes applies to numbers that don't match any other window.
+func (c *Configuration) sendWindows() ([]sendWindow, error) {
+	var ws []sendWindow
+	for i, cw := range c.SendWindows {
+		w := sendWindow{countryCodes: cw.CountryCodes, zone: cw.TimeZone}
+		if w.zone == "" {
+			w.zone = "UTC"
+		}
+		var err error
+		if w.loc, err = time.LoadLocation(w.zone); err != nil {
+			return nil, fmt.Errorf("Send window %v: unknown time zone %v", i+1, cw.TimeZone)
+		}
+		if w.start, err = parseClock(cw.Start); err != nil {
+			return nil, fmt.Errorf("Send window %v: %v", i+1, err)
+		}
+		if w.end, err = parseClock(cw.End); err != nil {
+			return nil, fmt.Errorf("Send window %v: %v", i+1, err)
+		}
+		if w.start == w.end {
+			return nil, fmt.Errorf("Send window %v: start and end are the same", i+1)
+		}
+		if len(cw.Days) > 0 {
+			w.days = map[time.Weekday]bool{}
+			for _, d := range cw.Days {
+				wd, ok := weekdays[strings.ToLower(d)]
+				if !ok {
+					return nil, fmt.Errorf("Send window %v: unknown day %v", i+1, d)
+				}
+				w.days[wd] = true
+			}
+		}
+		ws = append(ws, w)
+	}
+	return ws, nil
+}
+
+func (w *sendWindow) dayAllowed(t time.Time) bool {
+	return w.days == nil || w.days[t.Weekday()]
+}
+
+// contains reports whether t falls within the window.  A window that ends
+// before it starts, such as 22:00 to 06:00, runs past midnight, and belongs to
+// the day on which it opened.
+func (w *sendWindow) contains(t time.Time) bool {
+	lt := t.In(w.loc)
+	m := lt.Hour()*60 + lt.Minute()
+	if w.start < w.end {
+		return w.dayAllowed(lt) && m >= w.start && m < w.end
+	}
+	return (m >= w.start && w.dayAllowed(lt)) || (m < w.end && w.dayAllowed(lt.AddDate(0, 0, -1)))
+}
+
+// next returns t if it falls within the window, or else the next time that the window opens
+func (w *sendWindow) next(t time.Time) time.Time {
+	if w.contains(t) {
+		return t
+	}
+	lt := t.In(w.loc)
+	for i := 0; i <= 7; i++ {
+		o := time.Date(lt.Year(), lt.Month(), lt.Day()+i, w.start/60, w.start%60, 0, 0, w.loc)
+		if o.After(t) && w.dayAllowed(o) {
+			return o.UTC()
+		}
+	}
+	return t
+}
+
+// windowFor finds the send window of a number by the longest matching country
+// code, falling back to a window without country codes.  It returns nil if no
+// window applies.
+func (s *MessagingServer) windowFor(msisdn string) *sendWindow {
+	var best *sendWindow
+	bestLen := -1
+	for i := range s.windows {
+		w := &s.windows[i]
+		if len(w.countryCodes) == 0 && bestLen < 0 {
+			best, bestLen = w, 0
+		}
+		for _, cc := range w.countryCodes {
+			if strings.HasPrefix(msisdn, cc) && len(cc) > bestLen {
+				best, bestLen = w, len(cc)
+			}
+		}
+	}
+	return best
+}
+
+// cancelDeferred cancels the deferrals of a request that failed
+func (s *MessagingServer) cancelDeferred(sss []ScheduledSend) {
+	for _, ss := range sss {
+		if err := s.DB.cancelSchedule(ss.ID); err != nil {
+			s.Log.Errorf("Could not cancel deferred send %v: %v", ss.ID, err)
+		}
+	}
+}
+
+// checkSendWindows returns an error if the send window of any of the recipients
+// is closed at the given time
+func (s *MessagingServer) checkSendWindows(rms []RecipientMessage, at time.Time) error {
+	closed := 0
+	var opens time.Time
+	for _, rm := range rms {
+		w := s.windowFor(rm.MSISDN)
+		if w == nil || w.contains(at) {
+			continue
+		}
+		closed++
+		if o := w.next(at); opens.IsZero() || o.Before(opens) {
+			opens = o
+		}
+	}
+	if closed > 0 {
+		return fmt.Errorf("sendAt is outside the send window of %v recipients, the first of which opens at %v",
+			closed, opens.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ScheduleOutsideWindows applies the send windows to messages that are to be
+// sent at the given time.  Messages to recipients whose window is closed at that
+// time are scheduled for the next opening of their window, grouped by opening
+// time, unless the priority is urgent or emergency.  The remaining messages are
+// returned to be sent as requested.  If any of the deferrals can't be scheduled,
+// those that were already scheduled are cancelled.
+func (s *MessagingServer) ScheduleOutsideWindows(t Template, eml string, rms []RecipientMessage, at time.Time, priority string) ([]RecipientMessage, []ScheduledSend, error) {
+	if !validPriority(priority) {
+		return nil, nil, errors.New("Priority must be normal, urgent or emergency")
+	}
+	if priority == PriorityUrgent || priority == PriorityEmergency || len(s.windows) == 0 {
+		return rms, nil, nil
+	}
+
+	type deferral struct {
+		at   time.Time
+		zone string
+	}
+	var now []RecipientMessage
+	deferred := map[deferral][]RecipientMessage{}
+	for _, rm := range rms {
+		w := s.windowFor(rm.MSISDN)
+		if w == nil || w.contains(at) {
+			now = append(now, rm)
+			continue
+		}
+		d := deferral{w.next(at), w.zone}
+		deferred[d] = append(deferred[d], rm)
+	}
+
+	ds := make([]deferral, 0, len(deferred))
+	for d := range deferred {
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].at.Before(ds[j].at) })
+	sss := []ScheduledSend{}
+	for _, d := range ds {
+		s.Log.Infof("Deferring %v messages from %v to %v, outside of the send window", len(deferred[d]), eml, d.at)
+		ss, err := s.ScheduleSMS(t, eml, deferred[d], d.at, d.zone, priority)
+		if err != nil {
+			// The request fails as a whole, so none of its messages may be sent later
+			s.cancelDeferred(sss)
+			return nil, nil, err
+		}
+		sss = append(sss, ss)
+	}
+	return now, sss, nil
+}
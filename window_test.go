@@ -0,0 +1,61 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendWindow(t *testing.T) {
+	conf := Configuration{SendWindows: []ConfigSendWindow{
+		{Start: "08:00", End: "17:00", Days: []string{"Mon", "Tue", "Wed", "Thu", "Fri"}},
+		{Start: "22:00", End: "06:00", Days: []string{"fri"}},
+		{Start: "22:00", End: "06:00"},
+	}}
+	ws, err := conf.sendWindows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 5 January 2024 is a Friday
+	at := func(day, hour, min int) time.Time { return time.Date(2024, 1, day, hour, min, 0, 0, time.UTC) }
+	for _, c := range []struct {
+		window   int
+		t        time.Time
+		contains bool
+		next     time.Time
+	}{
+		{0, at(5, 10, 0), true, at(5, 10, 0)},
+		{0, at(5, 17, 0), false, at(8, 8, 0)}, // Closes at the end time, and reopens on Monday
+		{0, at(6, 10, 0), false, at(8, 8, 0)}, // Excluded day
+		{0, at(8, 7, 59), false, at(8, 8, 0)},
+		{1, at(5, 23, 0), true, at(5, 23, 0)},
+		{1, at(6, 3, 0), true, at(6, 3, 0)},     // Past midnight, but opened on Friday
+		{1, at(6, 6, 0), false, at(12, 22, 0)},  // Closed, and next opens the following Friday
+		{1, at(6, 23, 0), false, at(12, 22, 0)}, // Doesn't open on Saturday
+		{1, at(5, 3, 0), false, at(5, 22, 0)},   // Opened on Thursday, which is excluded
+		{2, at(9, 5, 59), true, at(9, 5, 59)},
+		{2, at(9, 6, 0), false, at(9, 22, 0)},
+		{2, at(9, 21, 59), false, at(9, 22, 0)},
+	} {
+		w := &ws[c.window]
+		if got := w.contains(c.t); got != c.contains {
+			t.Errorf("Window %v: contains(%v) = %v", c.window, c.t, got)
+		}
+		if got := w.next(c.t); !got.Equal(c.next) {
+			t.Errorf("Window %v: next(%v) = %v, want %v", c.window, c.t, got, c.next)
+		}
+	}
+}
+
+func TestSendWindowsInvalid(t *testing.T) {
+	for _, cw := range []ConfigSendWindow{
+		{Start: "8am", End: "17:00"},
+		{Start: "08:00", End: "08:00"},
+		{Start: "08:00", End: "17:00", TimeZone: "Nowhere/Special"},
+		{Start: "08:00", End: "17:00", Days: []string{"Funday"}},
+	} {
+		c := Configuration{SendWindows: []ConfigSendWindow{cw}}
+		if _, err := c.sendWindows(); err == nil {
+			t.Errorf("Expected window %+v to be invalid", cw)
+		}
+	}
+}